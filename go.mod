@@ -8,11 +8,12 @@ require (
 	github.com/docker/distribution v2.7.1+incompatible // indirect
 	github.com/docker/docker v1.13.1
 	github.com/docker/engine v1.13.1 // indirect
-	github.com/docker/go-connections v0.4.0 // indirect
+	github.com/docker/go-connections v0.4.0
 	github.com/docker/go-units v0.4.0 // indirect
 	github.com/envoyproxy/go-control-plane v0.9.6
 	github.com/golang/protobuf v1.4.2
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	go.uber.org/zap v1.16.0
 	google.golang.org/grpc v1.27.0
+	gopkg.in/yaml.v2 v2.4.0
 )
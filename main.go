@@ -3,25 +3,59 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/kahgeh/whale-disco/pkg/certs"
 	"github.com/kahgeh/whale-disco/pkg/mappers"
-	"github.com/kahgeh/whale-disco/pkg/registry/whale"
+	"github.com/kahgeh/whale-disco/pkg/registry"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kahgeh/whale-disco/pkg/ctx"
 	"github.com/kahgeh/whale-disco/pkg/logger"
 	"github.com/kahgeh/whale-disco/pkg/server"
+	"github.com/kahgeh/whale-disco/pkg/status"
+	"github.com/kahgeh/whale-disco/pkg/validation"
+	"github.com/kahgeh/whale-disco/pkg/watcher"
+
+	// discovery sources register themselves with the registry
+	_ "github.com/kahgeh/whale-disco/pkg/registry/file"
+	_ "github.com/kahgeh/whale-disco/pkg/registry/whale"
 
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
-	testv3 "github.com/envoyproxy/go-control-plane/pkg/test/v3"
 )
 
 var (
-	verbose    bool
-	port       uint
-	domainName string
-	nodeID     string
+	verbose            bool
+	port               uint
+	domainName         string
+	nodeID             string
+	nodeHash           string
+	sources            string
+	listener           mappers.ListenerOptions
+	listenerPort       uint
+	httpsListener      mappers.ListenerOptions
+	httpsPort          uint
+	certDir            string
+	certPollInterval   time.Duration
+	conflictPolicy     string
+	statusPort         uint
+	versionHeader      string
+	clusterDefaults    mappers.ClusterDefaults
+	consecutive5xx     uint
+	maxEjectionPercent uint
+	maxConnections     uint
+	maxPendingRequests uint
+	maxRequests        uint
+	maxRetries         uint
+)
+
+const (
+	nodeHashID      = "id"
+	nodeHashCluster = "cluster"
 )
 
 func init() {
@@ -29,8 +63,33 @@ func init() {
 	flag.BoolVar(&verbose, "verbose", false, "detailed log level")
 	// The port that this xDS server listens on
 	flag.UintVar(&port, "port", 18000, "xDS management server port")
-	// Tell Envoy to use this Node ID
-	flag.StringVar(&nodeID, "nodeID", "test-id", "Node ID")
+	// Snapshots are kept for this Node ID even before it connects, other nodes get theirs as they connect
+	flag.StringVar(&nodeID, "nodeID", "test-id", "Node ID, or node cluster with -nodeHash=cluster")
+	flag.StringVar(&nodeHash, "nodeHash", nodeHashID,
+		fmt.Sprintf("%q gives every envoy node id its own snapshot, %q shares a snapshot between nodes of the same node cluster", nodeHashID, nodeHashCluster))
+	flag.BoolVar(&listener.Enabled, "listener", true, "publish the HTTP listener through LDS, disable it when envoy declares a static listener")
+	flag.StringVar(&listener.Address, "listenerAddress", "0.0.0.0", "address the HTTP listener binds to")
+	flag.UintVar(&listenerPort, "listenerPort", mappers.ListenerPort, "port the HTTP listener binds to")
+	flag.StringVar(&listener.StatPrefix, "statPrefix", "ingress_http", "stat prefix of the HTTP connection manager")
+	flag.StringVar(&certDir, "certDir", "", "directory of <name>.crt and <name>.key pairs served through SDS on the HTTPS listener, no HTTPS listener when empty")
+	flag.DurationVar(&certPollInterval, "certPollInterval", 5*time.Second, "how often the certificate directory is checked for changes")
+	flag.UintVar(&httpsPort, "httpsListenerPort", 10443, "port the HTTPS listener binds to")
+	flag.StringVar(&httpsListener.StatPrefix, "httpsStatPrefix", "ingress_https", "stat prefix of the HTTPS connection manager")
+	flag.StringVar(&conflictPolicy, "conflictPolicy", string(validation.PolicyOldest),
+		fmt.Sprintf("what to do with conflicting front proxy paths, %q keeps the current config, %q or %q keep the path of the oldest or newest container",
+			validation.PolicyReject, validation.PolicyOldest, validation.PolicyNewest))
+	flag.UintVar(&statusPort, "statusPort", 18001, "port of the HTTP status endpoint, no status endpoint when 0")
+	flag.StringVar(&versionHeader, "versionHeader", "x-version", "request header routing to a single version of a cluster, no version routes when empty")
+	flag.UintVar(&consecutive5xx, "outlierConsecutive5xx", 5, "consecutive 5xx responses that eject an endpoint, no outlier detection when 0")
+	flag.DurationVar(&clusterDefaults.OutlierDetection.Interval, "outlierInterval", 10*time.Second, "time between outlier detection sweeps")
+	flag.DurationVar(&clusterDefaults.OutlierDetection.BaseEjectionTime, "outlierBaseEjectionTime", 30*time.Second, "how long an endpoint is ejected, multiplied by the number of times it was ejected")
+	flag.UintVar(&maxEjectionPercent, "outlierMaxEjectionPercent", 50, "the most endpoints of a cluster ejected at once, in percent")
+	flag.UintVar(&maxConnections, "maxConnections", 1024, "connections envoy opens to a cluster at most")
+	flag.UintVar(&maxPendingRequests, "maxPendingRequests", 1024, "requests waiting for a connection to a cluster at most")
+	flag.UintVar(&maxRequests, "maxRequests", 1024, "requests outstanding to a cluster at most")
+	flag.UintVar(&maxRetries, "maxRetries", 3, "retries outstanding to a cluster at most")
+	flag.StringVar(&sources, "sources", string(types.PluginDocker),
+		fmt.Sprintf("comma separated discovery sources in order of precedence, available sources are %s", strings.Join(registry.Names(), ", ")))
 }
 
 func initLog(verbose bool) {
@@ -41,8 +100,110 @@ func initLog(verbose bool) {
 	logger.Initialise(level)
 }
 
+func startSources(names string) <-chan *types.EndpointUpdateRequest {
+	log := logger.New("startSources")
+	defer log.LogDone()
+	selectedSources, err := registry.NewAll(names)
+	if err != nil {
+		log.Fail(err.Error())
+	}
+	for _, source := range selectedSources {
+		if err := source.Start(); err != nil {
+			log.Failf("failed to start source %q, %s", source.Name(), err.Error())
+		}
+		log.Infof("started source %q", source.Name())
+	}
+	return registry.NewAggregator(selectedSources).Run(ctx.GetContext())
+}
+
+func newNodeHash(name string) (cachev3.NodeHash, error) {
+	switch name {
+	case nodeHashID:
+		return cachev3.IDHash{}, nil
+	case nodeHashCluster:
+		return server.NodeClusterHash{}, nil
+	}
+	return nil, fmt.Errorf("unknown node hash %q, expecting %q or %q", name, nodeHashID, nodeHashCluster)
+}
+
+// setSnapshot maps the endpoints visible to a node group and replaces the group's snapshot
+func setSnapshot(cache cachev3.SnapshotCache, nodeGroup string, clusterEndpoints map[string][]types.Endpoint, certificates []certs.Certificate, version int) error {
+	log := logger.New("setSnapshot")
+	defer log.LogDone()
+	options := mappers.SnapshotOptions{
+		DomainName:      domainName,
+		Listener:        listener,
+		HTTPSListener:   httpsListener,
+		Certificates:    certificates,
+		VersionHeader:   versionHeader,
+		ClusterDefaults: clusterDefaults,
+	}
+	newSnapshot, err := mappers.MapToSnapshot(types.FilterByNodeGroup(clusterEndpoints, nodeGroup), strconv.Itoa(version), options)
+	if err != nil {
+		return err
+	}
+	if err := cache.SetSnapshot(nodeGroup, newSnapshot); err != nil {
+		log.Failf("snapshot error %q for %+v", err, newSnapshot)
+	}
+	log.Infof("config of %q replaced with version %v", nodeGroup, version)
+	return nil
+}
+
+// watchCertificates signals certificate directory changes, it never signals when there is no certificate directory
+func watchCertificates() <-chan struct{} {
+	if len(certDir) < 1 {
+		return nil
+	}
+	return watcher.Watch(ctx.GetContext(), certDir, certPollInterval)
+}
+
+func reportStatus(board *status.Board, version int, clusterEndpoints map[string][]types.Endpoint, nodeGroups map[string]bool, result validation.Result) {
+	report := status.Report{
+		Version:    version,
+		UpdatedAt:  time.Now(),
+		Validation: result,
+	}
+	for clusterName := range clusterEndpoints {
+		report.Clusters = append(report.Clusters, clusterName)
+	}
+	sort.Strings(report.Clusters)
+	for nodeGroup := range nodeGroups {
+		report.NodeGroups = append(report.NodeGroups, nodeGroup)
+	}
+	sort.Strings(report.NodeGroups)
+	board.Set(report)
+}
+
+func logDiff(diffs map[string]types.ClusterDiff) {
+	log := logger.New("logDiff")
+	defer log.LogDone()
+	var clusterNames []string
+	for clusterName := range diffs {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Strings(clusterNames)
+	for _, clusterName := range clusterNames {
+		diff := diffs[clusterName]
+		log.Infof("cluster %q added %v, removed %v, changed %v endpoints: %s",
+			clusterName, len(diff.Added), len(diff.Removed), len(diff.Changed), diff)
+	}
+}
+
 func main() {
 	flag.Parse()
+	listener.Port = uint32(listenerPort)
+	httpsListener.Enabled = len(certDir) > 0
+	httpsListener.Address = listener.Address
+	httpsListener.Port = uint32(httpsPort)
+	defaultConsecutive5xx := uint32(consecutive5xx)
+	clusterDefaults.OutlierDetection.Consecutive5xx = &defaultConsecutive5xx
+	clusterDefaults.OutlierDetection.MaxEjectionPercent = uint32(maxEjectionPercent)
+	clusterDefaults.CircuitBreakers = types.CircuitBreakers{
+		MaxConnections:     uint32(maxConnections),
+		MaxPendingRequests: uint32(maxPendingRequests),
+		MaxRequests:        uint32(maxRequests),
+		MaxRetries:         uint32(maxRetries),
+	}
 	initLog(verbose)
 	log := logger.New("runWhaleDisco")
 	defer log.LogDone()
@@ -51,17 +212,33 @@ func main() {
 	defer ctx.CleanUp()
 	go ctx.WaitOnCtrlCSignalOrCompletion()
 
+	hash, err := newNodeHash(nodeHash)
+	if err != nil {
+		log.Fail(err.Error())
+	}
+	policy, err := validation.ParsePolicy(conflictPolicy)
+	if err != nil {
+		log.Fail(err.Error())
+	}
+	board := status.NewBoard()
+	if statusPort > 0 {
+		go status.RunServer(ctx.GetContext(), board, statusPort)
+	}
+
 	// Create a cache
-	cache := cachev3.NewSnapshotCache(false, cachev3.IDHash{}, log)
+	cache := cachev3.NewSnapshotCache(false, hash, log)
 
 	// RunInBackground the xDS server
-	cb := &testv3.Callbacks{Debug: verbose}
+	cb := server.NewCallbacks(ctx.GetContext(), hash)
 	srv := serverv3.NewServer(ctx.GetContext(), cache, cb)
 	go server.RunServer(ctx.GetContext(), srv, port)
-	dockerRegistry := whale.New()
-	updateChannel := dockerRegistry.Run()
+	updateChannel := startSources(sources)
 	appContext := ctx.GetContext()
 	var previousUpdateHash uint32
+	var previousClusterEndpoints map[string][]types.Endpoint
+	nodeGroups := map[string]bool{nodeID: true}
+	var certificates []certs.Certificate
+	certChanges := watchCertificates()
 	version := 1
 
 	for {
@@ -69,25 +246,77 @@ func main() {
 		case update := <-updateChannel:
 			if update.GetHash() != previousUpdateHash {
 				log.Info("different version detected, updating snapshot...")
-				clusterEndpoints := update.GroupByCluster()
+				clusterEndpoints, result := validation.Validate(update.GroupByCluster(), policy, domainName)
+				if err := result.Err(); err != nil {
+					log.Warnf("Skip update because %s", err.Error())
+					reportStatus(board, version, previousClusterEndpoints, nodeGroups, result)
+					continue
+				}
 				v, _ := json.Marshal(clusterEndpoints)
 				log.Info("discovered", string(v))
+				mappers.WarnOverlaps(clusterEndpoints, domainName)
 				version = version + 1
-				newSnapshot, err := mappers.MapToSnapshot(clusterEndpoints, strconv.Itoa(version), domainName)
-				if err != nil {
-					log.Warnf("Skip update because %s", err.Error())
-					continue
+				var failed bool
+				for nodeGroup := range nodeGroups {
+					if err := setSnapshot(cache, nodeGroup, clusterEndpoints, certificates, version); err != nil {
+						log.Warnf("Skip update of %q because %s", nodeGroup, err.Error())
+						failed = true
+					}
 				}
-				if err := cache.SetSnapshot(nodeID, newSnapshot); err != nil {
-					log.Failf("snapshot error %q for %+v", err, newSnapshot)
+				if failed {
+					continue
 				}
+				logDiff(types.Diff(previousClusterEndpoints, clusterEndpoints))
+				reportStatus(board, version, clusterEndpoints, nodeGroups, result)
 				previousUpdateHash = update.GetHash()
+				previousClusterEndpoints = clusterEndpoints
 				log.Infof("config replaced with version %v", version)
 			}
+		case nodeGroup := <-cb.NewNodes:
+			// the node may be gone already when its streams closed before it was announced
+			if nodeGroups[nodeGroup] || !cb.IsConnected(nodeGroup) {
+				continue
+			}
+			nodeGroups[nodeGroup] = true
+			if previousClusterEndpoints == nil {
+				continue
+			}
+			if err := setSnapshot(cache, nodeGroup, previousClusterEndpoints, certificates, version); err != nil {
+				log.Warnf("Skip update of %q because %s", nodeGroup, err.Error())
+			}
+		case nodeGroup := <-cb.GoneNodes:
+			// the default node group is always kept, so is a node group that reconnected in the meantime
+			if nodeGroup == nodeID || cb.IsConnected(nodeGroup) {
+				continue
+			}
+			log.Infof("no node of %q is connected anymore, clearing its snapshot", nodeGroup)
+			delete(nodeGroups, nodeGroup)
+			cache.ClearSnapshot(nodeGroup)
+		case _, ok := <-certChanges:
+			if !ok {
+				// the watcher is done, a nil channel is never selected
+				certChanges = nil
+				continue
+			}
+			loaded, err := certs.Load(certDir)
+			if err != nil {
+				log.Warnf("Keep current certificates because %s", err.Error())
+				continue
+			}
+			log.Infof("loaded %v certificates from %q", len(loaded), certDir)
+			certificates = loaded
+			if previousClusterEndpoints == nil {
+				continue
+			}
+			version = version + 1
+			for nodeGroup := range nodeGroups {
+				if err := setSnapshot(cache, nodeGroup, previousClusterEndpoints, certificates, version); err != nil {
+					log.Warnf("Skip update of %q because %s", nodeGroup, err.Error())
+				}
+			}
 		case <-appContext.Done():
 			return
 		}
-		<-time.After(5 * time.Second)
 	}
 
 }
@@ -0,0 +1,77 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	certificateExtension = ".crt"
+	keyExtension         = ".key"
+)
+
+// Certificate is a certificate chain and private key pair, served for the names it was issued to
+type Certificate struct {
+	Name        string
+	ServerNames []string
+	Chain       []byte
+	PrivateKey  []byte
+}
+
+func getServerNames(chain []byte, key []byte) ([]string, error) {
+	pair, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	serverNames := append([]string{}, leaf.DNSNames...)
+	if len(serverNames) < 1 && len(leaf.Subject.CommonName) > 0 {
+		serverNames = append(serverNames, leaf.Subject.CommonName)
+	}
+	if len(serverNames) < 1 {
+		return nil, fmt.Errorf("certificate has no DNS names")
+	}
+	sort.Strings(serverNames)
+	return serverNames, nil
+}
+
+// Load reads every <name>.crt and <name>.key pair in a directory, the server names come from the certificate's DNS names
+func Load(dir string) ([]Certificate, error) {
+	chainPaths, err := filepath.Glob(filepath.Join(dir, "*"+certificateExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(chainPaths)
+	var certificates []Certificate
+	for _, chainPath := range chainPaths {
+		name := strings.TrimSuffix(filepath.Base(chainPath), certificateExtension)
+		keyPath := filepath.Join(dir, name+keyExtension)
+		chain, err := ioutil.ReadFile(chainPath)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %q has no key, %s", name, err.Error())
+		}
+		serverNames, err := getServerNames(chain, key)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %q is invalid, %s", name, err.Error())
+		}
+		certificates = append(certificates, Certificate{
+			Name:        name,
+			ServerNames: serverNames,
+			Chain:       chain,
+			PrivateKey:  key,
+		})
+	}
+	return certificates, nil
+}
@@ -172,18 +172,18 @@ func (logger *Logger) Fail(args ...interface{}) {
 }
 
 func (logger *Logger) Failf(template string, args ...interface{}) {
-	logger.sugaredLogger.Errorf(template, args)
+	logger.sugaredLogger.Errorf(template, args...)
 	os.Exit(ExitFailureStatus)
 }
 
 func (logger *Logger) Warn(args ...interface{}) {
-	logger.sugaredLogger.Warn(args)
+	logger.sugaredLogger.Warn(args...)
 }
 
 func (logger *Logger) Warnf(template string, args ...interface{}) {
-	logger.sugaredLogger.Warnf(template, args)
+	logger.sugaredLogger.Warnf(template, args...)
 }
 
 func (logger *Logger) Errorf(template string, args ...interface{}) {
-	logger.sugaredLogger.Errorf(template, args)
+	logger.sugaredLogger.Errorf(template, args...)
 }
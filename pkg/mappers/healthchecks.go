@@ -0,0 +1,77 @@
+package mappers
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+const (
+	defaultHealthCheckInterval           = 10 * time.Second
+	defaultHealthCheckTimeout            = 5 * time.Second
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+	defaultHealthCheckPath               = "/"
+)
+
+func durationOrDefault(duration time.Duration, defaultDuration time.Duration) time.Duration {
+	if duration > 0 {
+		return duration
+	}
+	return defaultDuration
+}
+
+func countOrDefault(count uint32, defaultCount uint32) uint32 {
+	if count > 0 {
+		return count
+	}
+	return defaultCount
+}
+
+func mapToHealthChecker(healthCheck *rTypes.HealthCheck) *core.HealthCheck {
+	mapped := &core.HealthCheck{}
+	switch healthCheck.Protocol {
+	case rTypes.HealthCheckTCP:
+		mapped.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+		}
+	case rTypes.HealthCheckGRPC:
+		mapped.HealthChecker = &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{},
+		}
+	default:
+		path := healthCheck.Path
+		if len(path) < 1 {
+			path = defaultHealthCheckPath
+		}
+		mapped.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{Path: path},
+		}
+	}
+	return mapped
+}
+
+// mapToHealthChecks adds envoy's active health check to a cluster, gRPC health checks need the cluster to speak HTTP/2
+func mapToHealthChecks(mappedCluster *cluster.Cluster, healthCheck *rTypes.HealthCheck) {
+	if healthCheck == nil {
+		return
+	}
+	mapped := mapToHealthChecker(healthCheck)
+	mapped.Interval = ptypes.DurationProto(durationOrDefault(healthCheck.Interval, defaultHealthCheckInterval))
+	mapped.Timeout = ptypes.DurationProto(durationOrDefault(healthCheck.Timeout, defaultHealthCheckTimeout))
+	mapped.HealthyThreshold = &wrappers.UInt32Value{
+		Value: countOrDefault(healthCheck.HealthyThreshold, defaultHealthCheckHealthyThreshold),
+	}
+	mapped.UnhealthyThreshold = &wrappers.UInt32Value{
+		Value: countOrDefault(healthCheck.UnhealthyThreshold, defaultHealthCheckUnhealthyThreshold),
+	}
+	mappedCluster.HealthChecks = []*core.HealthCheck{mapped}
+	if healthCheck.Protocol == rTypes.HealthCheckGRPC {
+		mappedCluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	}
+}
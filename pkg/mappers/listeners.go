@@ -0,0 +1,208 @@
+package mappers
+
+import (
+	"github.com/golang/protobuf/ptypes"
+	"github.com/kahgeh/whale-disco/pkg/certs"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+)
+
+const (
+	httpListenerName  = "listener_http"
+	httpsListenerName = "listener_https"
+)
+
+// ListenerOptions describes the HTTP listener generated for envoy
+type ListenerOptions struct {
+	Enabled    bool
+	Address    string
+	Port       uint32
+	StatPrefix string
+}
+
+func mapToHTTPConnectionManager(routeName string, statPrefix string) *hcm.HttpConnectionManager {
+	return &hcm.HttpConnectionManager{
+		CodecType:  hcm.HttpConnectionManager_AUTO,
+		StatPrefix: statPrefix,
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource:    makeConfigSource(),
+				RouteConfigName: routeName,
+			},
+		},
+		HttpFilters: []*hcm.HttpFilter{{
+			Name: wellknown.Router,
+		}},
+	}
+}
+
+func mapToHTTPConnectionManagerFilter(routeName string, statPrefix string) (*listener.Filter, error) {
+	manager, err := ptypes.MarshalAny(mapToHTTPConnectionManager(routeName, statPrefix))
+	if err != nil {
+		return nil, err
+	}
+	return &listener.Filter{
+		Name: wellknown.HTTPConnectionManager,
+		ConfigType: &listener.Filter_TypedConfig{
+			TypedConfig: manager,
+		},
+	}, nil
+}
+
+func mapToSocketAddress(address string, port uint32) *core.Address {
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol: core.SocketAddress_TCP,
+				Address:  address,
+				PortSpecifier: &core.SocketAddress_PortValue{
+					PortValue: port,
+				},
+			},
+		},
+	}
+}
+
+func mapToHTTPListener(routeName string, options ListenerOptions) (*listener.Listener, error) {
+	filter, err := mapToHTTPConnectionManagerFilter(routeName, options.StatPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &listener.Listener{
+		Name:    httpListenerName,
+		Address: mapToSocketAddress(options.Address, options.Port),
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{filter},
+		}},
+	}, nil
+}
+
+func mapToSecret(certificate certs.Certificate) *auth.Secret {
+	return &auth.Secret{
+		Name: certificate.Name,
+		Type: &auth.Secret_TlsCertificate{
+			TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{InlineBytes: certificate.Chain},
+				},
+				PrivateKey: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{InlineBytes: certificate.PrivateKey},
+				},
+			},
+		},
+	}
+}
+
+func mapToSecrets(certificates []certs.Certificate) []types.Resource {
+	secrets := []types.Resource{}
+	for _, certificate := range certificates {
+		secrets = append(secrets, mapToSecret(certificate))
+	}
+	return secrets
+}
+
+func mapToTLSTransportSocket(secretName string) (*core.TransportSocket, error) {
+	tlsContext, err := ptypes.MarshalAny(&auth.DownstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{
+				Name:      secretName,
+				SdsConfig: makeConfigSource(),
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &core.TransportSocket{
+		Name: wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: tlsContext,
+		},
+	}, nil
+}
+
+func mapToTLSFilterChain(certificate certs.Certificate, serverNames []string, filter *listener.Filter) (*listener.FilterChain, error) {
+	transportSocket, err := mapToTLSTransportSocket(certificate.Name)
+	if err != nil {
+		return nil, err
+	}
+	filterChain := &listener.FilterChain{
+		Filters:         []*listener.Filter{filter},
+		TransportSocket: transportSocket,
+	}
+	if len(serverNames) > 0 {
+		filterChain.FilterChainMatch = &listener.FilterChainMatch{
+			ServerNames: serverNames,
+		}
+	}
+	return filterChain, nil
+}
+
+// mapToHTTPSListener has a filter chain for every certificate matched by SNI, the first certificate is also served to clients without SNI
+func mapToHTTPSListener(routeName string, options ListenerOptions, certificates []certs.Certificate) (*listener.Listener, error) {
+	log := logger.New("mapToHTTPSListener")
+	defer log.LogDone()
+	filter, err := mapToHTTPConnectionManagerFilter(routeName, options.StatPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var filterChains []*listener.FilterChain
+	claimedServerNames := make(map[string]string)
+	for _, certificate := range certificates {
+		var serverNames []string
+		for _, serverName := range certificate.ServerNames {
+			if claimedBy, claimed := claimedServerNames[serverName]; claimed {
+				log.Warnf("%q of certificate %q is already served by certificate %q", serverName, certificate.Name, claimedBy)
+				continue
+			}
+			claimedServerNames[serverName] = certificate.Name
+			serverNames = append(serverNames, serverName)
+		}
+		if len(serverNames) < 1 {
+			continue
+		}
+		filterChain, err := mapToTLSFilterChain(certificate, serverNames, filter)
+		if err != nil {
+			return nil, err
+		}
+		filterChains = append(filterChains, filterChain)
+	}
+	defaultFilterChain, err := mapToTLSFilterChain(certificates[0], nil, filter)
+	if err != nil {
+		return nil, err
+	}
+	filterChains = append(filterChains, defaultFilterChain)
+	return &listener.Listener{
+		Name:    httpsListenerName,
+		Address: mapToSocketAddress(options.Address, options.Port),
+		ListenerFilters: []*listener.ListenerFilter{{
+			Name: wellknown.TlsInspector,
+		}},
+		FilterChains: filterChains,
+	}, nil
+}
+
+func mapToListeners(routeName string, options SnapshotOptions) ([]types.Resource, error) {
+	listeners := []types.Resource{}
+	if options.Listener.Enabled {
+		httpListener, err := mapToHTTPListener(routeName, options.Listener)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, httpListener)
+	}
+	if options.HTTPSListener.Enabled && len(options.Certificates) > 0 {
+		httpsListener, err := mapToHTTPSListener(routeName, options.HTTPSListener, options.Certificates)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, httpsListener)
+	}
+	return listeners, nil
+}
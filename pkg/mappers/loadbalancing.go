@@ -0,0 +1,66 @@
+package mappers
+
+import (
+	"github.com/golang/protobuf/ptypes"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func mapToLbPolicy(policy rTypes.LbPolicy) cluster.Cluster_LbPolicy {
+	switch policy {
+	case rTypes.LbLeastRequest:
+		return cluster.Cluster_LEAST_REQUEST
+	case rTypes.LbRandom:
+		return cluster.Cluster_RANDOM
+	case rTypes.LbRingHash:
+		return cluster.Cluster_RING_HASH
+	case rTypes.LbMaglev:
+		return cluster.Cluster_MAGLEV
+	}
+	return cluster.Cluster_ROUND_ROBIN
+}
+
+func mapToHashPolicy(hashPolicy rTypes.HashPolicy) *route.RouteAction_HashPolicy {
+	switch hashPolicy.Kind {
+	case rTypes.HashHeader:
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{HeaderName: hashPolicy.Name},
+			},
+		}
+	case rTypes.HashCookie:
+		// the ttl is always set so that envoy hands out the cookie to requests without one
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+				Cookie: &route.RouteAction_HashPolicy_Cookie{
+					Name: hashPolicy.Name,
+					Ttl:  ptypes.DurationProto(hashPolicy.TTL),
+					Path: "/",
+				},
+			},
+		}
+	case rTypes.HashSourceIP:
+		return &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+				ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+			},
+		}
+	}
+	return nil
+}
+
+// mapToHashPolicies only hashes requests for consistent hashing policies, other policies ignore the hash
+func mapToHashPolicies(clusterEndpoint rTypes.Endpoint) []*route.RouteAction_HashPolicy {
+	if clusterEndpoint.LbPolicy != rTypes.LbRingHash && clusterEndpoint.LbPolicy != rTypes.LbMaglev {
+		return nil
+	}
+	var hashPolicies []*route.RouteAction_HashPolicy
+	for _, hashPolicy := range clusterEndpoint.HashPolicies {
+		if mapped := mapToHashPolicy(hashPolicy); mapped != nil {
+			hashPolicies = append(hashPolicies, mapped)
+		}
+	}
+	return hashPolicies
+}
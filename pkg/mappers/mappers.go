@@ -3,15 +3,19 @@ package mappers
 import (
 	"errors"
 	"fmt"
+	"github.com/kahgeh/whale-disco/pkg/certs"
 	"github.com/kahgeh/whale-disco/pkg/logger"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
@@ -20,8 +24,20 @@ import (
 
 const ListenerPort = 10000
 
-func mapToCluster(clusterName string) *cluster.Cluster {
-	return &cluster.Cluster{
+// SnapshotOptions holds the snapshot settings that do not come from discovered endpoints
+type SnapshotOptions struct {
+	DomainName      string
+	Listener        ListenerOptions
+	HTTPSListener   ListenerOptions
+	Certificates    []certs.Certificate
+	ClusterDefaults ClusterDefaults
+	// VersionHeader is the request header selecting a cluster version, no version routes are added when empty
+	VersionHeader string
+}
+
+// mapToCluster takes the cluster settings from any of its endpoints, validation makes them share the settings like they share the front proxy path
+func mapToCluster(clusterName string, clusterEndpoints []rTypes.Endpoint, defaults ClusterDefaults) *cluster.Cluster {
+	mappedCluster := &cluster.Cluster{
 		Name:                      clusterName,
 		ConnectTimeout:            ptypes.DurationProto(5 * time.Second),
 		ClusterDiscoveryType:      &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
@@ -32,13 +48,30 @@ func mapToCluster(clusterName string) *cluster.Cluster {
 			EdsConfig:   makeConfigSource(),
 		},
 	}
-
+	var anyEndpoint rTypes.Endpoint
+	if len(clusterEndpoints) > 0 {
+		anyEndpoint = clusterEndpoints[0]
+	}
+	mappedCluster.LbPolicy = mapToLbPolicy(anyEndpoint.LbPolicy)
+	mapToHealthChecks(mappedCluster, anyEndpoint.HealthCheck)
+	mappedCluster.OutlierDetection = mapToOutlierDetection(anyEndpoint.OutlierDetection, defaults.OutlierDetection)
+	mappedCluster.CircuitBreakers = mapToCircuitBreakers(anyEndpoint.CircuitBreakers, defaults.CircuitBreakers)
+	return mappedCluster
 }
 
-func mapToClusters(clusterEndPoints map[string][]rTypes.Endpoint) []types.Resource {
+func mapToClusters(clusterEndPoints map[string][]rTypes.Endpoint, defaults ClusterDefaults) []types.Resource {
 	var clusters []types.Resource
-	for name := range clusterEndPoints {
-		clusters = append(clusters, mapToCluster(name))
+	for name, endpoints := range clusterEndPoints {
+		splits := mapToVersionSplits(name, endpoints)
+		baseCluster := mapToCluster(name, endpoints, defaults)
+		if len(splits) > 0 {
+			baseCluster.LbSubsetConfig = mapToVersionSubsets()
+		}
+		clusters = append(clusters, baseCluster)
+		// version clusters share the settings of the whole cluster, e.g. the load balancing policy that goes with the route's hash policy
+		for _, split := range splits {
+			clusters = append(clusters, mapToCluster(split.clusterName, endpoints, defaults))
+		}
 	}
 	return clusters
 }
@@ -47,6 +80,10 @@ func mapToEndpointsResources(clusterEndPoints map[string][]rTypes.Endpoint) []ty
 	var endpointResources []types.Resource
 	for name, endpoints := range clusterEndPoints {
 		endpointResources = append(endpointResources, mapToEndpoints(name, endpoints))
+		versions := groupByVersion(endpoints)
+		for _, split := range mapToVersionSplits(name, endpoints) {
+			endpointResources = append(endpointResources, mapToEndpoints(split.clusterName, versions[split.version]))
+		}
 	}
 	return endpointResources
 }
@@ -72,84 +109,125 @@ func mapToEndpoints(clusterName string, clusterEndpoints []rTypes.Endpoint) *end
 	}
 }
 
+func mapToHealthStatus(health rTypes.HealthStatus) core.HealthStatus {
+	switch health {
+	case rTypes.HealthHealthy:
+		return core.HealthStatus_HEALTHY
+	case rTypes.HealthUnhealthy:
+		return core.HealthStatus_UNHEALTHY
+	case rTypes.HealthDraining:
+		return core.HealthStatus_DRAINING
+	}
+	return core.HealthStatus_UNKNOWN
+}
+
 func mapToEndpoint(clusterEndpoint rTypes.Endpoint) *endpoint.LbEndpoint {
 	host := clusterEndpoint.Host
 	port := clusterEndpoint.Port
+	var loadBalancingWeight *wrappers.UInt32Value
+	if clusterEndpoint.EndpointWeight > 0 {
+		loadBalancingWeight = &wrappers.UInt32Value{Value: clusterEndpoint.EndpointWeight}
+	}
 	return &endpoint.LbEndpoint{
+		LoadBalancingWeight: loadBalancingWeight,
+		HealthStatus:        mapToHealthStatus(clusterEndpoint.Health),
+		Metadata:            mapToVersionMetadata(clusterEndpoint.Version),
 		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 			Endpoint: &endpoint.Endpoint{
 				HealthCheckConfig: &endpoint.Endpoint_HealthCheckConfig{
 					Hostname:  host,
 					PortValue: port,
 				},
-				Address: &core.Address{
-					Address: &core.Address_SocketAddress{
-						SocketAddress: &core.SocketAddress{
-							Protocol: core.SocketAddress_TCP,
-							Address:  host,
-							PortSpecifier: &core.SocketAddress_PortValue{
-								PortValue: port,
-							},
-						},
-					},
-				},
+				Address: mapToSocketAddress(host, port),
 			},
 		},
 	}
 }
 
-func mapToRoutes(clusterEndPoints map[string][]rTypes.Endpoint, routeName string, domainName string) []types.Resource {
+func mapToRoutes(clusterEndPoints map[string][]rTypes.Endpoint, routeName string, domainName string, versionHeader string) []types.Resource {
 	log := logger.New("mapToRoutes")
 	defer log.LogDone()
-	var routes []*route.Route
-	for clusterName, endpoints := range clusterEndPoints {
-		if endpoints == nil || len(endpoints) < 1 {
-			continue
+	var virtualHosts []*route.VirtualHost
+	for _, host := range groupByDomains(clusterEndPoints, domainName) {
+		var routes []*route.Route
+		for _, clusterRoute := range orderClusterRoutes(clusterEndPoints, host.clusterNames) {
+			clusterName, prefix := clusterRoute.clusterName, clusterRoute.prefix
+			endpoints := clusterEndPoints[clusterName]
+			log.Infof("%q's cluster is %s, with %v endpoints, served on %v", prefix, clusterName, len(endpoints), host.domains)
+			routes = append(routes, mapToVersionRoutes(prefix, clusterName, endpoints, versionHeader)...)
+			routes = append(routes, mapToClusterRoutes(prefix, clusterName, endpoints)...)
 		}
-		anyEndpoint := endpoints[0]
-		prefix := anyEndpoint.FrontProxyPath
-		log.Infof("%q's cluster is %s, with %v endpoints", prefix, clusterName, len(endpoints))
-		routes = append(routes, mapToClusterRoutes(prefix, clusterName)...)
+		virtualHosts = append(virtualHosts, &route.VirtualHost{
+			Name:    host.name,
+			Domains: host.domains,
+			Routes:  routes,
+		})
 	}
 
 	return []types.Resource{
 		&route.RouteConfiguration{
-			Name: routeName,
-			VirtualHosts: []*route.VirtualHost{{
-				Name:    "backend",
-				Domains: []string{domainName},
-				Routes:  routes,
-			}},
+			Name:         routeName,
+			VirtualHosts: virtualHosts,
 		}}
 }
 
-func mapToClusterRoutes(prefix string, clusterName string) []*route.Route {
-
-	return []*route.Route{{
-		Match: &route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: fmt.Sprintf("%s/", prefix),
+func mapToRewrite(routeAction *route.RouteAction, clusterEndpoint rTypes.Endpoint, matchesTrailingSlash bool) {
+	if len(clusterEndpoint.RewriteRegex) > 0 {
+		routeAction.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+			Pattern: &matcher.RegexMatcher{
+				EngineType: &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{}},
+				Regex:      clusterEndpoint.RewriteRegex,
 			},
+			Substitution: clusterEndpoint.Rewrite,
+		}
+		return
+	}
+	if len(clusterEndpoint.Rewrite) < 1 {
+		return
+	}
+	routeAction.PrefixRewrite = clusterEndpoint.Rewrite
+	if matchesTrailingSlash {
+		// keep the separator between the rewritten prefix and the rest of the path
+		routeAction.PrefixRewrite = fmt.Sprintf("%s/", strings.TrimSuffix(clusterEndpoint.Rewrite, "/"))
+	}
+}
+
+// mapToRouteAction routes to the cluster, or splits traffic between its versions when it has more than one
+func mapToRouteAction(clusterName string, clusterEndpoints []rTypes.Endpoint, matchesTrailingSlash bool) *route.RouteAction {
+	routeAction := &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_Cluster{
+			Cluster: clusterName,
 		},
-		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: clusterName,
-				},
-			},
-		}}, {
+	}
+	if weightedClusters := mapToWeightedClusters(mapToVersionSplits(clusterName, clusterEndpoints)); weightedClusters != nil {
+		routeAction.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+			WeightedClusters: weightedClusters,
+		}
+	}
+	routeAction.HashPolicy = mapToHashPolicies(clusterEndpoints[0])
+	mapToTimeouts(routeAction, clusterEndpoints[0])
+	mapToRewrite(routeAction, clusterEndpoints[0], matchesTrailingSlash)
+	return routeAction
+}
+
+func mapToPrefixRoute(prefix string, headers []*route.HeaderMatcher, routeAction *route.RouteAction) *route.Route {
+	return &route.Route{
 		Match: &route.RouteMatch{
 			PathSpecifier: &route.RouteMatch_Prefix{
 				Prefix: prefix,
 			},
+			Headers: headers,
 		},
 		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: clusterName,
-				},
-			},
-		}},
+			Route: routeAction,
+		}}
+}
+
+func mapToClusterRoutes(prefix string, clusterName string, clusterEndpoints []rTypes.Endpoint) []*route.Route {
+
+	return []*route.Route{
+		mapToPrefixRoute(fmt.Sprintf("%s/", prefix), nil, mapToRouteAction(clusterName, clusterEndpoints, true)),
+		mapToPrefixRoute(prefix, nil, mapToRouteAction(clusterName, clusterEndpoints, false)),
 	}
 }
 
@@ -191,19 +269,32 @@ func Consistent(s *cache.Snapshot) error {
 	if err := superset(endpoints, s.Resources[types.Endpoint].Items); err != nil {
 		return err
 	}
-	return nil
+	if len(s.Resources[types.Listener].Items) < 1 {
+		// routes are referenced by envoy's static listeners
+		return nil
+	}
+	routes := cache.GetResourceReferences(s.Resources[types.Listener].Items)
+	if len(routes) != len(s.Resources[types.Route].Items) {
+		return fmt.Errorf("mismatched route reference and resource lengths: %v != %d", routes, len(s.Resources[types.Route].Items))
+	}
+	return superset(routes, s.Resources[types.Route].Items)
 }
 
-func MapToSnapshot(clusterEndPoints map[string][]rTypes.Endpoint, version string, domainName string) (newSnapshot cache.Snapshot, err error) {
+func MapToSnapshot(clusterEndPoints map[string][]rTypes.Endpoint, version string, options SnapshotOptions) (newSnapshot cache.Snapshot, err error) {
 	routeName := "discovered_container_services"
+	listeners, err := mapToListeners(routeName, options)
+	if err != nil {
+		return newSnapshot, err
+	}
 	newSnapshot = cache.NewSnapshot(
 		version,
 		mapToEndpointsResources(clusterEndPoints), // endpoints
-		mapToClusters(clusterEndPoints),
-		mapToRoutes(clusterEndPoints, routeName, domainName),
-		[]types.Resource{},
+		mapToClusters(clusterEndPoints, options.ClusterDefaults),
+		mapToRoutes(clusterEndPoints, routeName, options.DomainName, options.VersionHeader),
+		listeners,
 		[]types.Resource{}, // runtimes
 	)
+	newSnapshot.Resources[types.Secret] = cache.NewResources(version, mapToSecrets(options.Certificates))
 
 	return newSnapshot, Consistent(&newSnapshot)
 }
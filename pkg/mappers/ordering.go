@@ -0,0 +1,71 @@
+package mappers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+type clusterRoute struct {
+	clusterName string
+	prefix      string
+	priority    int
+}
+
+// orderClusterRoutes sorts routes by priority, then longest prefix first so that a shorter prefix never shadows a longer one,
+// ties are broken by prefix and cluster name to keep the order stable across restarts
+func orderClusterRoutes(clusterEndPoints map[string][]rTypes.Endpoint, clusterNames []string) []clusterRoute {
+	var clusterRoutes []clusterRoute
+	for _, clusterName := range clusterNames {
+		anyEndpoint := clusterEndPoints[clusterName][0]
+		clusterRoutes = append(clusterRoutes, clusterRoute{
+			clusterName: clusterName,
+			prefix:      anyEndpoint.FrontProxyPath,
+			priority:    anyEndpoint.RoutePriority,
+		})
+	}
+	sort.SliceStable(clusterRoutes, func(i, j int) bool {
+		a, b := clusterRoutes[i], clusterRoutes[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if len(a.prefix) != len(b.prefix) {
+			return len(a.prefix) > len(b.prefix)
+		}
+		if a.prefix != b.prefix {
+			return a.prefix < b.prefix
+		}
+		return a.clusterName < b.clusterName
+	})
+	return clusterRoutes
+}
+
+// WarnOverlaps logs the overlapping prefixes of every domain, it is meant to run once per update
+// rather than for every node group the routes are built for
+func WarnOverlaps(clusterEndPoints map[string][]rTypes.Endpoint, domainName string) {
+	for _, host := range groupByDomains(clusterEndPoints, domainName) {
+		warnOverlaps(orderClusterRoutes(clusterEndPoints, host.clusterNames))
+	}
+}
+
+// warnOverlaps logs every pair of prefixes where requests for one could also be matched by the other
+func warnOverlaps(clusterRoutes []clusterRoute) {
+	log := logger.New("warnOverlaps")
+	defer log.LogDone()
+	for i, first := range clusterRoutes {
+		for _, second := range clusterRoutes[i+1:] {
+			if !strings.HasPrefix(second.prefix, first.prefix) && !strings.HasPrefix(first.prefix, second.prefix) {
+				continue
+			}
+			if len(first.prefix) < len(second.prefix) {
+				log.Warnf("%q of cluster %q shadows %q of cluster %q because of its higher priority",
+					first.prefix, first.clusterName, second.prefix, second.clusterName)
+				continue
+			}
+			log.Warnf("%q of cluster %q overlaps %q of cluster %q, it is matched first",
+				first.prefix, first.clusterName, second.prefix, second.clusterName)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package mappers
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// ClusterDefaults are used for the cluster settings that the endpoints leave out
+type ClusterDefaults struct {
+	// OutlierDetection is turned off when Consecutive5xx is 0
+	OutlierDetection rTypes.OutlierDetection
+	CircuitBreakers  rTypes.CircuitBreakers
+}
+
+// mapToCount leaves the count to envoy's default when neither the endpoint nor the defaults set it
+func mapToCount(count uint32, defaultCount uint32) *wrappers.UInt32Value {
+	if count = countOrDefault(count, defaultCount); count < 1 {
+		return nil
+	}
+	return &wrappers.UInt32Value{Value: count}
+}
+
+func mapToDuration(value time.Duration, defaultValue time.Duration) *duration.Duration {
+	if value = durationOrDefault(value, defaultValue); value <= 0 {
+		return nil
+	}
+	return ptypes.DurationProto(value)
+}
+
+func mapToOutlierDetection(outlierDetection rTypes.OutlierDetection, defaults rTypes.OutlierDetection) *cluster.OutlierDetection {
+	consecutive5xx := outlierDetection.Consecutive5xx
+	if consecutive5xx == nil {
+		consecutive5xx = defaults.Consecutive5xx
+	}
+	// an explicit 0, on the endpoint or as the default, turns outlier detection off
+	if consecutive5xx == nil || *consecutive5xx < 1 {
+		return nil
+	}
+	maxEjectionPercent := mapToCount(outlierDetection.MaxEjectionPercent, defaults.MaxEjectionPercent)
+	if maxEjectionPercent != nil && maxEjectionPercent.Value > 100 {
+		maxEjectionPercent.Value = 100
+	}
+	return &cluster.OutlierDetection{
+		Consecutive_5Xx:    &wrappers.UInt32Value{Value: *consecutive5xx},
+		Interval:           mapToDuration(outlierDetection.Interval, defaults.Interval),
+		BaseEjectionTime:   mapToDuration(outlierDetection.BaseEjectionTime, defaults.BaseEjectionTime),
+		MaxEjectionPercent: maxEjectionPercent,
+	}
+}
+
+func mapToCircuitBreakers(circuitBreakers rTypes.CircuitBreakers, defaults rTypes.CircuitBreakers) *cluster.CircuitBreakers {
+	return &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+			Priority:           core.RoutingPriority_DEFAULT,
+			MaxConnections:     mapToCount(circuitBreakers.MaxConnections, defaults.MaxConnections),
+			MaxPendingRequests: mapToCount(circuitBreakers.MaxPendingRequests, defaults.MaxPendingRequests),
+			MaxRequests:        mapToCount(circuitBreakers.MaxRequests, defaults.MaxRequests),
+			MaxRetries:         mapToCount(circuitBreakers.MaxRetries, defaults.MaxRetries),
+		}},
+	}
+}
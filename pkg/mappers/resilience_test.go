@@ -0,0 +1,45 @@
+package mappers
+
+import (
+	"testing"
+
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func count(value uint32) *uint32 {
+	return &value
+}
+
+func TestMapToOutlierDetectionConsecutive5xx(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		consecutive5xx *uint32
+		defaultValue   *uint32
+		expected       uint32
+	}{
+		{"default", nil, count(5), 5},
+		{"set", count(3), count(5), 3},
+		{"set without default", count(3), nil, 3},
+		{"turned off", count(0), count(5), 0},
+		{"turned off by default", nil, count(0), 0},
+		{"turned on against the default", count(7), count(0), 7},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outlierDetection := mapToOutlierDetection(
+				rTypes.OutlierDetection{Consecutive5xx: tc.consecutive5xx},
+				rTypes.OutlierDetection{Consecutive5xx: tc.defaultValue})
+			if tc.expected < 1 {
+				if outlierDetection != nil {
+					t.Errorf("outlier detection is on, %v", outlierDetection)
+				}
+				return
+			}
+			if outlierDetection == nil {
+				t.Fatal("outlier detection is off")
+			}
+			if value := outlierDetection.Consecutive_5Xx.GetValue(); value != tc.expected {
+				t.Errorf("consecutive 5xx is %v, expecting %v", value, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package mappers
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// mapToTimeout leaves the timeout to envoy when it is not set, a zero timeout turns it off
+func mapToTimeout(timeout *time.Duration) *duration.Duration {
+	if timeout == nil {
+		return nil
+	}
+	return ptypes.DurationProto(*timeout)
+}
+
+func mapToRetryPolicy(retryPolicy rTypes.RetryPolicy) *route.RetryPolicy {
+	if len(retryPolicy.RetryOn) < 1 {
+		return nil
+	}
+	mapped := &route.RetryPolicy{
+		RetryOn: retryPolicy.RetryOn,
+	}
+	if retryPolicy.NumRetries > 0 {
+		mapped.NumRetries = &wrappers.UInt32Value{Value: retryPolicy.NumRetries}
+	}
+	if retryPolicy.PerTryTimeout > 0 {
+		mapped.PerTryTimeout = ptypes.DurationProto(retryPolicy.PerTryTimeout)
+	}
+	return mapped
+}
+
+// mapToTimeouts sets the timeouts and retries of a route
+func mapToTimeouts(routeAction *route.RouteAction, clusterEndpoint rTypes.Endpoint) {
+	routeAction.Timeout = mapToTimeout(clusterEndpoint.Timeout)
+	routeAction.IdleTimeout = mapToTimeout(clusterEndpoint.IdleTimeout)
+	routeAction.RetryPolicy = mapToRetryPolicy(clusterEndpoint.RetryPolicy)
+}
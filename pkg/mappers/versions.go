@@ -0,0 +1,193 @@
+package mappers
+
+import (
+	"fmt"
+	"sort"
+
+	_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+const (
+	// subsetMetadataNamespace is where envoy's subset load balancer looks for endpoint metadata
+	subsetMetadataNamespace = "envoy.lb"
+	versionMetadataKey      = "version"
+)
+
+// totalVersionWeight is shared by the versions of a cluster, versions without a weight split what labelled versions leave
+const totalVersionWeight = 100
+
+type versionSplit struct {
+	version     string
+	clusterName string
+	weight      uint32
+	// labelled is set when the weight comes from a weight label
+	labelled bool
+}
+
+// versionClusterName names the cluster holding only the endpoints of one version
+func versionClusterName(clusterName string, version string) string {
+	return fmt.Sprintf("%s@%s", clusterName, version)
+}
+
+func groupByVersion(endpoints []rTypes.Endpoint) map[string][]rTypes.Endpoint {
+	versions := make(map[string][]rTypes.Endpoint)
+	for _, endpoint := range endpoints {
+		versions[endpoint.Version] = append(versions[endpoint.Version], endpoint)
+	}
+	return versions
+}
+
+// getVersionWeight is the weight labelled on any endpoint of the version
+func getVersionWeight(endpoints []rTypes.Endpoint) (uint32, bool) {
+	for _, endpoint := range endpoints {
+		if endpoint.VersionWeight != nil {
+			return *endpoint.VersionWeight, true
+		}
+	}
+	return 0, false
+}
+
+// isAvailable indicates that a version has an endpoint ready for requests, versions that are still starting,
+// or draining like the old version of a rolling update, are not
+func isAvailable(endpoints []rTypes.Endpoint) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.Health == rTypes.HealthHealthy || endpoint.Health == rTypes.HealthUnknown {
+			return true
+		}
+	}
+	return false
+}
+
+// mapToVersionSplits gives every version of a cluster its share of the traffic, nothing is split when the cluster has a single version,
+// versions that are not available get no share
+func mapToVersionSplits(clusterName string, endpoints []rTypes.Endpoint) []versionSplit {
+	versions := groupByVersion(endpoints)
+	if len(versions) < 2 {
+		return nil
+	}
+	var versionNames []string
+	for version := range versions {
+		versionNames = append(versionNames, version)
+	}
+	sort.Strings(versionNames)
+
+	var splits []versionSplit
+	var labelledWeight uint32
+	var unlabelled []int
+	for _, version := range versionNames {
+		weight, labelled := getVersionWeight(versions[version])
+		split := versionSplit{
+			version:     version,
+			clusterName: versionClusterName(clusterName, version),
+			weight:      weight,
+			labelled:    labelled,
+		}
+		switch {
+		case !isAvailable(versions[version]):
+			split.weight = 0
+		case labelled:
+			labelledWeight += weight
+		default:
+			unlabelled = append(unlabelled, len(splits))
+		}
+		splits = append(splits, split)
+	}
+	if labelledWeight < totalVersionWeight && len(unlabelled) > 0 {
+		remaining := totalVersionWeight - labelledWeight
+		share := remaining / uint32(len(unlabelled))
+		for position, index := range unlabelled {
+			splits[index].weight = share
+			if position == 0 {
+				splits[index].weight += remaining % uint32(len(unlabelled))
+			}
+		}
+	}
+	return splits
+}
+
+// mapToWeightedClusters splits traffic between version clusters, versions with no weight are left out.
+// Nothing is split unless a version has a weight label, e.g. a rolling update that only bumps the version
+// keeps sending traffic to the whole cluster
+func mapToWeightedClusters(splits []versionSplit) *route.WeightedCluster {
+	var labelled bool
+	for _, split := range splits {
+		labelled = labelled || split.labelled
+	}
+	if !labelled {
+		return nil
+	}
+	weightedCluster := &route.WeightedCluster{}
+	var totalWeight uint32
+	for _, split := range splits {
+		if split.weight < 1 {
+			continue
+		}
+		totalWeight += split.weight
+		weightedCluster.Clusters = append(weightedCluster.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   split.clusterName,
+			Weight: &wrappers.UInt32Value{Value: split.weight},
+		})
+	}
+	if totalWeight < 1 {
+		return nil
+	}
+	weightedCluster.TotalWeight = &wrappers.UInt32Value{Value: totalWeight}
+	return weightedCluster
+}
+
+// mapToVersionMetadata labels an endpoint with its version for the subset load balancer
+func mapToVersionMetadata(version string) *core.Metadata {
+	return &core.Metadata{
+		FilterMetadata: map[string]*_struct.Struct{
+			subsetMetadataNamespace: {
+				Fields: map[string]*_struct.Value{
+					versionMetadataKey: {Kind: &_struct.Value_StringValue{StringValue: version}},
+				},
+			},
+		},
+	}
+}
+
+// mapToVersionSubsets lets routes pick the endpoints of a version, routes without a version use every endpoint
+func mapToVersionSubsets() *cluster.Cluster_LbSubsetConfig {
+	return &cluster.Cluster_LbSubsetConfig{
+		FallbackPolicy: cluster.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+		SubsetSelectors: []*cluster.Cluster_LbSubsetConfig_LbSubsetSelector{{
+			Keys: []string{versionMetadataKey},
+		}},
+	}
+}
+
+func mapToVersionRouteAction(clusterName string, clusterEndpoints []rTypes.Endpoint, version string, matchesTrailingSlash bool) *route.RouteAction {
+	routeAction := mapToRouteAction(clusterName, clusterEndpoints, matchesTrailingSlash)
+	routeAction.ClusterSpecifier = &route.RouteAction_Cluster{
+		Cluster: clusterName,
+	}
+	routeAction.MetadataMatch = mapToVersionMetadata(version)
+	return routeAction
+}
+
+// mapToVersionRoutes sends requests carrying the version header to the endpoints of that version,
+// they come ahead of the cluster's routes so that requests without the header keep going to every version
+func mapToVersionRoutes(prefix string, clusterName string, clusterEndpoints []rTypes.Endpoint, versionHeader string) []*route.Route {
+	if len(versionHeader) < 1 {
+		return nil
+	}
+	var routes []*route.Route
+	for _, split := range mapToVersionSplits(clusterName, clusterEndpoints) {
+		headers := []*route.HeaderMatcher{{
+			Name:                 versionHeader,
+			HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: split.version},
+		}}
+		routes = append(routes,
+			mapToPrefixRoute(fmt.Sprintf("%s/", prefix), headers, mapToVersionRouteAction(clusterName, clusterEndpoints, split.version, true)),
+			mapToPrefixRoute(prefix, headers, mapToVersionRouteAction(clusterName, clusterEndpoints, split.version, false)))
+	}
+	return routes
+}
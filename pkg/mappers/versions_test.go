@@ -0,0 +1,207 @@
+package mappers
+
+import (
+	"reflect"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func newVersionEndpoints(version string, count int, health rTypes.HealthStatus, weight *uint32) []rTypes.Endpoint {
+	var endpoints []rTypes.Endpoint
+	for i := 0; i < count; i++ {
+		endpoints = append(endpoints, rTypes.Endpoint{
+			ClusterName:   "c",
+			Version:       version,
+			Health:        health,
+			VersionWeight: weight,
+		})
+	}
+	return endpoints
+}
+
+func versions(endpoints ...[]rTypes.Endpoint) []rTypes.Endpoint {
+	var all []rTypes.Endpoint
+	for _, versionEndpoints := range endpoints {
+		all = append(all, versionEndpoints...)
+	}
+	return all
+}
+
+func TestMapToVersionSplits(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		endpoints []rTypes.Endpoint
+		weights   map[string]uint32
+		weighted  bool
+	}{
+		{
+			name:      "single version",
+			endpoints: newVersionEndpoints("v1", 3, rTypes.HealthHealthy, nil),
+			weights:   map[string]uint32{},
+		},
+		{
+			name: "rolling update without weight labels",
+			endpoints: versions(
+				newVersionEndpoints("v1", 9, rTypes.HealthHealthy, nil),
+				newVersionEndpoints("v2", 1, rTypes.HealthUnhealthy, nil)),
+			weights: map[string]uint32{"v1": 100, "v2": 0},
+		},
+		{
+			name: "unlabelled versions split evenly",
+			endpoints: versions(
+				newVersionEndpoints("v1", 2, rTypes.HealthUnknown, nil),
+				newVersionEndpoints("v2", 1, rTypes.HealthHealthy, nil),
+				newVersionEndpoints("v3", 1, rTypes.HealthHealthy, nil)),
+			weights: map[string]uint32{"v1": 34, "v2": 33, "v3": 33},
+		},
+		{
+			name: "canary",
+			endpoints: versions(
+				newVersionEndpoints("v1", 9, rTypes.HealthHealthy, nil),
+				newVersionEndpoints("v2", 1, rTypes.HealthHealthy, count(10))),
+			weights:  map[string]uint32{"v1": 90, "v2": 10},
+			weighted: true,
+		},
+		{
+			name: "canary still starting",
+			endpoints: versions(
+				newVersionEndpoints("v1", 9, rTypes.HealthHealthy, nil),
+				newVersionEndpoints("v2", 1, rTypes.HealthUnhealthy, count(10))),
+			weights:  map[string]uint32{"v1": 100, "v2": 0},
+			weighted: true,
+		},
+		{
+			name: "draining version",
+			endpoints: versions(
+				newVersionEndpoints("v1", 2, rTypes.HealthDraining, count(90)),
+				newVersionEndpoints("v2", 2, rTypes.HealthHealthy, nil)),
+			weights:  map[string]uint32{"v1": 0, "v2": 100},
+			weighted: true,
+		},
+		{
+			name: "version with one healthy endpoint",
+			endpoints: versions(
+				newVersionEndpoints("v1", 1, rTypes.HealthHealthy, nil),
+				newVersionEndpoints("v2", 1, rTypes.HealthDraining, count(20)),
+				newVersionEndpoints("v2", 1, rTypes.HealthHealthy, count(20))),
+			weights:  map[string]uint32{"v1": 80, "v2": 20},
+			weighted: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			splits := mapToVersionSplits("c", tc.endpoints)
+			weights := make(map[string]uint32)
+			for _, split := range splits {
+				if split.clusterName != versionClusterName("c", split.version) {
+					t.Errorf("cluster of %s is %q", split.version, split.clusterName)
+				}
+				weights[split.version] = split.weight
+			}
+			if !reflect.DeepEqual(weights, tc.weights) {
+				t.Errorf("weights are %v, expecting %v", weights, tc.weights)
+			}
+			if weighted := mapToWeightedClusters(splits) != nil; weighted != tc.weighted {
+				t.Errorf("weighted is %v, expecting %v", weighted, tc.weighted)
+			}
+		})
+	}
+}
+
+func TestMapToWeightedClusters(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		splits   []versionSplit
+		clusters map[string]uint32
+		total    uint32
+	}{
+		{
+			name: "no weight labels",
+			splits: []versionSplit{
+				{version: "v1", clusterName: "c@v1", weight: 50},
+				{version: "v2", clusterName: "c@v2", weight: 50},
+			},
+		},
+		{
+			name: "labelled",
+			splits: []versionSplit{
+				{version: "v1", clusterName: "c@v1", weight: 90},
+				{version: "v2", clusterName: "c@v2", weight: 10, labelled: true},
+			},
+			clusters: map[string]uint32{"c@v1": 90, "c@v2": 10},
+			total:    100,
+		},
+		{
+			name: "versions without weight are left out",
+			splits: []versionSplit{
+				{version: "v1", clusterName: "c@v1", weight: 100},
+				{version: "v2", clusterName: "c@v2", weight: 0, labelled: true},
+			},
+			clusters: map[string]uint32{"c@v1": 100},
+			total:    100,
+		},
+		{
+			name: "no version with a weight",
+			splits: []versionSplit{
+				{version: "v1", clusterName: "c@v1", weight: 0, labelled: true},
+				{version: "v2", clusterName: "c@v2", weight: 0},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			weightedCluster := mapToWeightedClusters(tc.splits)
+			if tc.clusters == nil {
+				if weightedCluster != nil {
+					t.Errorf("traffic is split, %v", weightedCluster)
+				}
+				return
+			}
+			if weightedCluster == nil {
+				t.Fatal("traffic is not split")
+			}
+			clusters := make(map[string]uint32)
+			for _, cluster := range weightedCluster.Clusters {
+				clusters[cluster.Name] = cluster.Weight.GetValue()
+			}
+			if !reflect.DeepEqual(clusters, tc.clusters) {
+				t.Errorf("clusters are %v, expecting %v", clusters, tc.clusters)
+			}
+			if total := weightedCluster.TotalWeight.GetValue(); total != tc.total {
+				t.Errorf("total weight is %v, expecting %v", total, tc.total)
+			}
+		})
+	}
+}
+
+func TestVersionClustersShareTheClusterSettings(t *testing.T) {
+	stable := newVersionEndpoints("v1", 1, rTypes.HealthHealthy, nil)
+	canary := newVersionEndpoints("v2", 1, rTypes.HealthHealthy, count(10))
+	// validation makes the endpoints agree, the canary disagrees here to show where the settings come from
+	canary[0].LbPolicy = rTypes.LbRingHash
+	canary[0].HashPolicies = []rTypes.HashPolicy{{Kind: rTypes.HashCookie, Name: "session"}}
+	for _, tc := range []struct {
+		name      string
+		endpoints []rTypes.Endpoint
+		lbPolicy  cluster.Cluster_LbPolicy
+	}{
+		{"stable first", versions(stable, canary), cluster.Cluster_ROUND_ROBIN},
+		{"canary first", versions(canary, stable), cluster.Cluster_RING_HASH},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clusters := mapToClusters(map[string][]rTypes.Endpoint{"c": tc.endpoints}, ClusterDefaults{})
+			if len(clusters) != 3 {
+				t.Fatalf("expecting the base cluster and a cluster per version, got %v", len(clusters))
+			}
+			hashed := len(mapToRouteAction("c", tc.endpoints, false).HashPolicy) > 0
+			if hashed != (tc.lbPolicy == cluster.Cluster_RING_HASH) {
+				t.Errorf("route hash policy does not go with load balancing policy %v", tc.lbPolicy)
+			}
+			for _, resource := range clusters {
+				if mapped := resource.(*cluster.Cluster); mapped.LbPolicy != tc.lbPolicy {
+					t.Errorf("%s load balancing policy is %v, expecting %v", mapped.Name, mapped.LbPolicy, tc.lbPolicy)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package mappers
+
+import (
+	"sort"
+	"strings"
+
+	rTypes "github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+const defaultVirtualHostName = "backend"
+
+type virtualHost struct {
+	name         string
+	domains      []string
+	clusterNames []string
+}
+
+func getClusterDomains(endpoints []rTypes.Endpoint, domainName string) []string {
+	if len(endpoints) < 1 || len(endpoints[0].Domains) < 1 {
+		return []string{domainName}
+	}
+	return endpoints[0].Domains
+}
+
+// groupByDomains gives every set of domains serving the same clusters its own virtual host,
+// clusters without domains are served on the default domain
+func groupByDomains(clusterEndPoints map[string][]rTypes.Endpoint, domainName string) []virtualHost {
+	domainClusters := make(map[string][]string)
+	for clusterName, endpoints := range clusterEndPoints {
+		if len(endpoints) < 1 {
+			continue
+		}
+		for _, domain := range getClusterDomains(endpoints, domainName) {
+			domainClusters[domain] = append(domainClusters[domain], clusterName)
+		}
+	}
+	if _, exists := domainClusters[domainName]; !exists {
+		domainClusters[domainName] = []string{}
+	}
+
+	virtualHostsByClusters := make(map[string]*virtualHost)
+	for domain, clusterNames := range domainClusters {
+		sort.Strings(clusterNames)
+		key := strings.Join(clusterNames, ",")
+		if _, exists := virtualHostsByClusters[key]; !exists {
+			virtualHostsByClusters[key] = &virtualHost{clusterNames: clusterNames}
+		}
+		virtualHostsByClusters[key].domains = append(virtualHostsByClusters[key].domains, domain)
+	}
+
+	var virtualHosts []virtualHost
+	for _, host := range virtualHostsByClusters {
+		sort.Strings(host.domains)
+		host.name = host.domains[0]
+		for _, domain := range host.domains {
+			if domain == domainName {
+				host.name = defaultVirtualHostName
+			}
+		}
+		virtualHosts = append(virtualHosts, *host)
+	}
+	sort.Slice(virtualHosts, func(i, j int) bool {
+		return virtualHosts[i].name < virtualHosts[j].name
+	})
+	return virtualHosts
+}
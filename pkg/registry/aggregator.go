@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// Aggregator keeps the latest update request of every source and merges them into one request.
+//
+// Sources are ranked by the order they are given in, when two sources publish the same cluster
+// with different front proxy paths the endpoints of the higher ranked source are kept and the
+// others are dropped.
+type Aggregator struct {
+	sources []Source
+	rank    map[string]int
+	latest  map[string]*types.EndpointUpdateRequest
+}
+
+type sourceUpdate struct {
+	name    string
+	request *types.EndpointUpdateRequest
+}
+
+func NewAggregator(sources []Source) *Aggregator {
+	rank := make(map[string]int)
+	for index, source := range sources {
+		rank[string(source.Name())] = index
+	}
+	return &Aggregator{
+		sources: sources,
+		rank:    rank,
+		latest:  make(map[string]*types.EndpointUpdateRequest),
+	}
+}
+
+// Update records request as the latest request of its plugin
+func (aggregator *Aggregator) Update(request *types.EndpointUpdateRequest) {
+	aggregator.latest[request.PluginName] = request
+}
+
+// Remove forgets the latest request of a plugin
+func (aggregator *Aggregator) Remove(pluginName string) {
+	delete(aggregator.latest, pluginName)
+}
+
+func (aggregator *Aggregator) rankedPluginNames() []string {
+	var names []string
+	for name := range aggregator.latest {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		iRank, iRanked := aggregator.rank[names[i]]
+		jRank, jRanked := aggregator.rank[names[j]]
+		if iRanked != jRanked {
+			return iRanked
+		}
+		if iRanked && iRank != jRank {
+			return iRank < jRank
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// Merge combines the latest request of every plugin, resolving cluster conflicts by source rank
+func (aggregator *Aggregator) Merge() *types.EndpointUpdateRequest {
+	log := logger.New("mergeUpdateRequests")
+	defer log.LogDone()
+	merged := &types.EndpointUpdateRequest{
+		PluginName: string(types.PluginAggregate),
+	}
+	type clusterClaim struct {
+		pluginName     string
+		frontProxyPath string
+	}
+	claims := make(map[string]clusterClaim)
+	for _, pluginName := range aggregator.rankedPluginNames() {
+		request := aggregator.latest[pluginName]
+		if request.Timestamp.After(merged.Timestamp) {
+			merged.Timestamp = request.Timestamp
+		}
+		dropped := make(map[string]bool)
+		for _, endpoint := range request.Endpoints {
+			claim, claimed := claims[endpoint.ClusterName]
+			if !claimed {
+				claims[endpoint.ClusterName] = clusterClaim{
+					pluginName:     pluginName,
+					frontProxyPath: endpoint.FrontProxyPath,
+				}
+			} else if claim.pluginName != pluginName && claim.frontProxyPath != endpoint.FrontProxyPath {
+				if !dropped[endpoint.ClusterName] {
+					log.Warnf("dropping cluster %q from %q, its path %q conflicts with %q from %q",
+						endpoint.ClusterName, pluginName, endpoint.FrontProxyPath, claim.frontProxyPath, claim.pluginName)
+					dropped[endpoint.ClusterName] = true
+				}
+				continue
+			}
+			merged.Endpoints = append(merged.Endpoints, endpoint)
+		}
+	}
+	if merged.Timestamp.IsZero() {
+		merged.Timestamp = time.Now()
+	}
+	return merged
+}
+
+// Run fans in the updates of all sources and publishes a merged request whenever any of them changes
+func (aggregator *Aggregator) Run(appContext context.Context) <-chan *types.EndpointUpdateRequest {
+	updates := make(chan sourceUpdate)
+	for _, source := range aggregator.sources {
+		go func(source Source) {
+			for request := range source.Updates() {
+				select {
+				case updates <- sourceUpdate{name: string(source.Name()), request: request}:
+				case <-appContext.Done():
+					return
+				}
+			}
+			select {
+			case updates <- sourceUpdate{name: string(source.Name())}:
+			case <-appContext.Done():
+			}
+		}(source)
+	}
+
+	mergedChannel := make(chan *types.EndpointUpdateRequest)
+	go func() {
+		defer close(mergedChannel)
+		for {
+			select {
+			case update := <-updates:
+				if update.request == nil {
+					aggregator.Remove(update.name)
+				} else {
+					aggregator.Update(update.request)
+				}
+				select {
+				case mergedChannel <- aggregator.Merge():
+				case <-appContext.Done():
+					return
+				}
+			case <-appContext.Done():
+				return
+			}
+		}
+	}()
+	return mergedChannel
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.Initialise(logger.NormalLogLevel)
+	os.Exit(m.Run())
+}
+
+// fakeSource publishes whatever is sent on its channel
+type fakeSource struct {
+	name    types.PluginType
+	updates chan *types.EndpointUpdateRequest
+}
+
+func newFakeSource(name types.PluginType) *fakeSource {
+	return &fakeSource{name: name, updates: make(chan *types.EndpointUpdateRequest)}
+}
+
+func (source *fakeSource) Name() types.PluginType {
+	return source.name
+}
+
+func (source *fakeSource) Start() error {
+	return nil
+}
+
+func (source *fakeSource) Stop() {
+	close(source.updates)
+}
+
+func (source *fakeSource) Updates() <-chan *types.EndpointUpdateRequest {
+	return source.updates
+}
+
+func newRequest(pluginName types.PluginType, endpoints ...types.Endpoint) *types.EndpointUpdateRequest {
+	return &types.EndpointUpdateRequest{
+		PluginName: string(pluginName),
+		Timestamp:  time.Now(),
+		Endpoints:  endpoints,
+	}
+}
+
+func newEndpoint(uniqueID string, clusterName string, path string) types.Endpoint {
+	return types.Endpoint{UniqueID: uniqueID, ClusterName: clusterName, FrontProxyPath: path}
+}
+
+func mergedIDs(request *types.EndpointUpdateRequest) []string {
+	ids := []string{}
+	for _, endpoint := range request.Endpoints {
+		ids = append(ids, endpoint.UniqueID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestMerge(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sources  []types.PluginType
+		requests []*types.EndpointUpdateRequest
+		merged   []string
+	}{
+		{
+			name:    "different clusters",
+			sources: []types.PluginType{types.PluginDocker, types.PluginFile},
+			requests: []*types.EndpointUpdateRequest{
+				newRequest(types.PluginDocker, newEndpoint("d1", "a", "/a")),
+				newRequest(types.PluginFile, newEndpoint("f1", "b", "/b")),
+			},
+			merged: []string{"d1", "f1"},
+		},
+		{
+			name:    "same cluster and path",
+			sources: []types.PluginType{types.PluginDocker, types.PluginFile},
+			requests: []*types.EndpointUpdateRequest{
+				newRequest(types.PluginDocker, newEndpoint("d1", "a", "/a")),
+				newRequest(types.PluginFile, newEndpoint("f1", "a", "/a")),
+			},
+			merged: []string{"d1", "f1"},
+		},
+		{
+			name:    "first source wins a conflicting path",
+			sources: []types.PluginType{types.PluginDocker, types.PluginFile},
+			requests: []*types.EndpointUpdateRequest{
+				newRequest(types.PluginFile, newEndpoint("f1", "a", "/legacy"), newEndpoint("f2", "b", "/b")),
+				newRequest(types.PluginDocker, newEndpoint("d1", "a", "/a")),
+			},
+			merged: []string{"d1", "f2"},
+		},
+		{
+			name:    "source order decides, not update order",
+			sources: []types.PluginType{types.PluginFile, types.PluginDocker},
+			requests: []*types.EndpointUpdateRequest{
+				newRequest(types.PluginFile, newEndpoint("f1", "a", "/legacy")),
+				newRequest(types.PluginDocker, newEndpoint("d1", "a", "/a"), newEndpoint("d2", "a", "/a")),
+			},
+			merged: []string{"f1"},
+		},
+		{
+			name:    "three sources",
+			sources: []types.PluginType{types.PluginDockerSwarm, types.PluginDocker, types.PluginFile},
+			requests: []*types.EndpointUpdateRequest{
+				newRequest(types.PluginFile, newEndpoint("f1", "a", "/file"), newEndpoint("f2", "b", "/b")),
+				newRequest(types.PluginDocker, newEndpoint("d1", "a", "/docker"), newEndpoint("d2", "b", "/b")),
+				newRequest(types.PluginDockerSwarm, newEndpoint("s1", "a", "/swarm")),
+			},
+			merged: []string{"d2", "f2", "s1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sources []Source
+			for _, name := range tc.sources {
+				sources = append(sources, newFakeSource(name))
+			}
+			aggregator := NewAggregator(sources)
+			for _, request := range tc.requests {
+				aggregator.Update(request)
+			}
+			merged := aggregator.Merge()
+			if merged.PluginName != string(types.PluginAggregate) {
+				t.Errorf("plugin name is %q", merged.PluginName)
+			}
+			if ids := mergedIDs(merged); !reflect.DeepEqual(ids, tc.merged) {
+				t.Errorf("merged %q, expecting %q", ids, tc.merged)
+			}
+		})
+	}
+}
+
+func receiveMerged(t *testing.T, merged <-chan *types.EndpointUpdateRequest) []string {
+	t.Helper()
+	select {
+	case request := <-merged:
+		return mergedIDs(request)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no merged update received")
+	}
+	return nil
+}
+
+func TestRunRemovesClosedSources(t *testing.T) {
+	appContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	docker, file := newFakeSource(types.PluginDocker), newFakeSource(types.PluginFile)
+	merged := NewAggregator([]Source{docker, file}).Run(appContext)
+
+	docker.updates <- newRequest(types.PluginDocker, newEndpoint("d1", "a", "/a"))
+	if ids := receiveMerged(t, merged); !reflect.DeepEqual(ids, []string{"d1"}) {
+		t.Fatalf("merged %q", ids)
+	}
+	file.updates <- newRequest(types.PluginFile, newEndpoint("f1", "a", "/legacy"), newEndpoint("f2", "b", "/b"))
+	if ids := receiveMerged(t, merged); !reflect.DeepEqual(ids, []string{"d1", "f2"}) {
+		t.Fatalf("merged %q", ids)
+	}
+
+	docker.Stop()
+	if ids := receiveMerged(t, merged); !reflect.DeepEqual(ids, []string{"f1", "f2"}) {
+		t.Errorf("merged %q after the docker source closed", ids)
+	}
+}
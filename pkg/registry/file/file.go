@@ -0,0 +1,363 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/ctx"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+	"github.com/kahgeh/whale-disco/pkg/watcher"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	endpointsFile string
+	pollInterval  time.Duration
+)
+
+// Source provides configuration from a static YAML or JSON file
+type Source struct {
+	path                 string
+	pollInterval         time.Duration
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	updateRequestChannel chan *types.EndpointUpdateRequest
+}
+
+type fileEndpoint struct {
+	ID               string               `json:"id" yaml:"id"`
+	ClusterName      string               `json:"clusterName" yaml:"clusterName"`
+	Host             string               `json:"host" yaml:"host"`
+	Port             uint32               `json:"port" yaml:"port"`
+	URLPrefix        string               `json:"urlPrefix" yaml:"urlPrefix"`
+	Version          string               `json:"version" yaml:"version"`
+	NodeGroups       []string             `json:"nodeGroups" yaml:"nodeGroups"`
+	Domains          []string             `json:"domains" yaml:"domains"`
+	Rewrite          string               `json:"rewrite" yaml:"rewrite"`
+	RewriteRegex     string               `json:"rewriteRegex" yaml:"rewriteRegex"`
+	Priority         int                  `json:"priority" yaml:"priority"`
+	Weight           *uint32              `json:"weight" yaml:"weight"`
+	HealthCheck      *fileHealthCheck     `json:"healthCheck" yaml:"healthCheck"`
+	OutlierDetection fileOutlierDetection `json:"outlierDetection" yaml:"outlierDetection"`
+	CircuitBreakers  fileCircuitBreakers  `json:"circuitBreakers" yaml:"circuitBreakers"`
+	LbPolicy         string               `json:"lbPolicy" yaml:"lbPolicy"`
+	HashPolicies     []string             `json:"hashPolicies" yaml:"hashPolicies"`
+	EndpointWeight   uint32               `json:"endpointWeight" yaml:"endpointWeight"`
+	Timeout          *string              `json:"timeout" yaml:"timeout"`
+	IdleTimeout      *string              `json:"idleTimeout" yaml:"idleTimeout"`
+	RetryPolicy      fileRetryPolicy      `json:"retryPolicy" yaml:"retryPolicy"`
+}
+
+type fileOutlierDetection struct {
+	Consecutive5xx     *uint32 `json:"consecutive5xx" yaml:"consecutive5xx"`
+	Interval           string  `json:"interval" yaml:"interval"`
+	BaseEjectionTime   string  `json:"baseEjectionTime" yaml:"baseEjectionTime"`
+	MaxEjectionPercent uint32  `json:"maxEjectionPercent" yaml:"maxEjectionPercent"`
+}
+
+type fileRetryPolicy struct {
+	RetryOn       string `json:"retryOn" yaml:"retryOn"`
+	NumRetries    uint32 `json:"numRetries" yaml:"numRetries"`
+	PerTryTimeout string `json:"perTryTimeout" yaml:"perTryTimeout"`
+}
+
+type fileCircuitBreakers struct {
+	MaxConnections     uint32 `json:"maxConnections" yaml:"maxConnections"`
+	MaxPendingRequests uint32 `json:"maxPendingRequests" yaml:"maxPendingRequests"`
+	MaxRequests        uint32 `json:"maxRequests" yaml:"maxRequests"`
+	MaxRetries         uint32 `json:"maxRetries" yaml:"maxRetries"`
+}
+
+// fileHealthCheck has durations written like 5s, so that they read the same in YAML and JSON
+type fileHealthCheck struct {
+	Protocol           string `json:"protocol" yaml:"protocol"`
+	Path               string `json:"path" yaml:"path"`
+	Interval           string `json:"interval" yaml:"interval"`
+	Timeout            string `json:"timeout" yaml:"timeout"`
+	HealthyThreshold   uint32 `json:"healthyThreshold" yaml:"healthyThreshold"`
+	UnhealthyThreshold uint32 `json:"unhealthyThreshold" yaml:"unhealthyThreshold"`
+}
+
+type endpointsDocument struct {
+	Endpoints []fileEndpoint `json:"endpoints" yaml:"endpoints"`
+}
+
+func init() {
+	flag.StringVar(&endpointsFile, "endpointsFile", "endpoints.yaml", "YAML or JSON file with static endpoints, used by the File source")
+	flag.DurationVar(&pollInterval, "endpointsFilePollInterval", 2*time.Second, "how often the endpoints file is checked for changes")
+	registry.Register(types.PluginFile, func() (registry.Source, error) {
+		return New(endpointsFile, pollInterval), nil
+	})
+}
+
+func New(path string, pollInterval time.Duration) *Source {
+	sourceCtx, cancel := context.WithCancel(ctx.GetContext())
+	return &Source{
+		path:                 path,
+		pollInterval:         pollInterval,
+		ctx:                  sourceCtx,
+		cancel:               cancel,
+		updateRequestChannel: make(chan *types.EndpointUpdateRequest),
+	}
+}
+
+func parse(path string, content []byte) (*endpointsDocument, error) {
+	document := &endpointsDocument{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(content, document)
+	default:
+		err = yaml.Unmarshal(content, document)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if len(value) < 1 {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (fileHealthCheck *fileHealthCheck) mapToHealthCheck() (*types.HealthCheck, error) {
+	if fileHealthCheck == nil {
+		return nil, nil
+	}
+	healthCheck := &types.HealthCheck{
+		Protocol:           types.HealthCheckHTTP,
+		Path:               fileHealthCheck.Path,
+		HealthyThreshold:   fileHealthCheck.HealthyThreshold,
+		UnhealthyThreshold: fileHealthCheck.UnhealthyThreshold,
+	}
+	var err error
+	if len(fileHealthCheck.Protocol) > 0 {
+		if healthCheck.Protocol, err = types.ParseHealthCheckProtocol(fileHealthCheck.Protocol); err != nil {
+			return nil, err
+		}
+	}
+	if healthCheck.Interval, err = parseDuration(fileHealthCheck.Interval); err != nil {
+		return nil, err
+	}
+	if healthCheck.Timeout, err = parseDuration(fileHealthCheck.Timeout); err != nil {
+		return nil, err
+	}
+	return healthCheck, nil
+}
+
+func (fileOutlierDetection fileOutlierDetection) mapToOutlierDetection() (types.OutlierDetection, error) {
+	outlierDetection := types.OutlierDetection{
+		Consecutive5xx:     fileOutlierDetection.Consecutive5xx,
+		MaxEjectionPercent: fileOutlierDetection.MaxEjectionPercent,
+	}
+	var err error
+	if outlierDetection.Interval, err = parseDuration(fileOutlierDetection.Interval); err != nil {
+		return outlierDetection, err
+	}
+	outlierDetection.BaseEjectionTime, err = parseDuration(fileOutlierDetection.BaseEjectionTime)
+	return outlierDetection, err
+}
+
+func (fileCircuitBreakers fileCircuitBreakers) mapToCircuitBreakers() types.CircuitBreakers {
+	return types.CircuitBreakers{
+		MaxConnections:     fileCircuitBreakers.MaxConnections,
+		MaxPendingRequests: fileCircuitBreakers.MaxPendingRequests,
+		MaxRequests:        fileCircuitBreakers.MaxRequests,
+		MaxRetries:         fileCircuitBreakers.MaxRetries,
+	}
+}
+
+func (fileEndpoint fileEndpoint) mapToLbPolicy() (types.LbPolicy, error) {
+	if len(fileEndpoint.LbPolicy) < 1 {
+		return types.LbRoundRobin, nil
+	}
+	return types.ParseLbPolicy(fileEndpoint.LbPolicy)
+}
+
+func (fileEndpoint fileEndpoint) mapToHashPolicies() ([]types.HashPolicy, error) {
+	var hashPolicies []types.HashPolicy
+	for _, value := range fileEndpoint.HashPolicies {
+		hashPolicy, err := types.ParseHashPolicy(value)
+		if err != nil {
+			return nil, err
+		}
+		hashPolicies = append(hashPolicies, hashPolicy)
+	}
+	return hashPolicies, nil
+}
+
+// parseTimeout keeps a missing timeout apart from a zero one, which turns the timeout off
+func parseTimeout(value *string) (*time.Duration, error) {
+	if value == nil {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(*value)
+	if err != nil {
+		return nil, err
+	}
+	return &timeout, nil
+}
+
+func (fileRetryPolicy fileRetryPolicy) mapToRetryPolicy() (types.RetryPolicy, error) {
+	retryPolicy := types.RetryPolicy{
+		RetryOn:    fileRetryPolicy.RetryOn,
+		NumRetries: fileRetryPolicy.NumRetries,
+	}
+	var err error
+	retryPolicy.PerTryTimeout, err = parseDuration(fileRetryPolicy.PerTryTimeout)
+	return retryPolicy, err
+}
+
+func (fileEndpoint fileEndpoint) validate() error {
+	if len(fileEndpoint.ClusterName) < 1 {
+		return fmt.Errorf("missing clusterName")
+	}
+	if len(fileEndpoint.Host) < 1 {
+		return fmt.Errorf("missing host for cluster %q", fileEndpoint.ClusterName)
+	}
+	if fileEndpoint.Port < 1 || fileEndpoint.Port > 65535 {
+		return fmt.Errorf("invalid port %v for cluster %q", fileEndpoint.Port, fileEndpoint.ClusterName)
+	}
+	if fileEndpoint.EndpointWeight > types.MaxEndpointWeight {
+		return fmt.Errorf("invalid endpointWeight %v for cluster %q, it is at most %v", fileEndpoint.EndpointWeight, fileEndpoint.ClusterName, types.MaxEndpointWeight)
+	}
+	if _, err := regexp.Compile(fileEndpoint.RewriteRegex); err != nil {
+		return fmt.Errorf("invalid rewriteRegex for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := fileEndpoint.HealthCheck.mapToHealthCheck(); err != nil {
+		return fmt.Errorf("invalid health check for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := fileEndpoint.OutlierDetection.mapToOutlierDetection(); err != nil {
+		return fmt.Errorf("invalid outlier detection for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := parseTimeout(fileEndpoint.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := parseTimeout(fileEndpoint.IdleTimeout); err != nil {
+		return fmt.Errorf("invalid idleTimeout for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := fileEndpoint.RetryPolicy.mapToRetryPolicy(); err != nil {
+		return fmt.Errorf("invalid retryPolicy for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := fileEndpoint.mapToLbPolicy(); err != nil {
+		return fmt.Errorf("invalid lbPolicy for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	if _, err := fileEndpoint.mapToHashPolicies(); err != nil {
+		return fmt.Errorf("invalid hashPolicies for cluster %q, %s", fileEndpoint.ClusterName, err.Error())
+	}
+	return nil
+}
+
+func (fileEndpoint fileEndpoint) mapToEndpoint() types.Endpoint {
+	uniqueID := fileEndpoint.ID
+	if len(uniqueID) < 1 {
+		uniqueID = fmt.Sprintf("%s/%s:%v", fileEndpoint.ClusterName, fileEndpoint.Host, fileEndpoint.Port)
+	}
+	frontProxyPath := fmt.Sprintf("/%s", fileEndpoint.ClusterName)
+	if len(fileEndpoint.URLPrefix) > 0 {
+		frontProxyPath = fileEndpoint.URLPrefix
+	}
+	// validated already
+	healthCheck, _ := fileEndpoint.HealthCheck.mapToHealthCheck()
+	outlierDetection, _ := fileEndpoint.OutlierDetection.mapToOutlierDetection()
+	lbPolicy, _ := fileEndpoint.mapToLbPolicy()
+	hashPolicies, _ := fileEndpoint.mapToHashPolicies()
+	timeout, _ := parseTimeout(fileEndpoint.Timeout)
+	idleTimeout, _ := parseTimeout(fileEndpoint.IdleTimeout)
+	retryPolicy, _ := fileEndpoint.RetryPolicy.mapToRetryPolicy()
+	return types.Endpoint{
+		UniqueID:         uniqueID,
+		ClusterName:      fileEndpoint.ClusterName,
+		Host:             fileEndpoint.Host,
+		Port:             fileEndpoint.Port,
+		FrontProxyPath:   frontProxyPath,
+		Version:          fileEndpoint.Version,
+		NodeGroups:       fileEndpoint.NodeGroups,
+		Domains:          fileEndpoint.Domains,
+		Rewrite:          fileEndpoint.Rewrite,
+		RewriteRegex:     fileEndpoint.RewriteRegex,
+		RoutePriority:    fileEndpoint.Priority,
+		VersionWeight:    fileEndpoint.Weight,
+		HealthCheck:      healthCheck,
+		OutlierDetection: outlierDetection,
+		CircuitBreakers:  fileEndpoint.CircuitBreakers.mapToCircuitBreakers(),
+		LbPolicy:         lbPolicy,
+		HashPolicies:     hashPolicies,
+		EndpointWeight:   fileEndpoint.EndpointWeight,
+		Timeout:          timeout,
+		IdleTimeout:      idleTimeout,
+		RetryPolicy:      retryPolicy,
+	}
+}
+
+func (source *Source) getEndpointUpdateRequest() (*types.EndpointUpdateRequest, error) {
+	content, err := ioutil.ReadFile(source.path)
+	if err != nil {
+		return nil, err
+	}
+	document, err := parse(source.path, content)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []types.Endpoint
+	for _, fileEndpoint := range document.Endpoints {
+		if err := fileEndpoint.validate(); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, fileEndpoint.mapToEndpoint())
+	}
+	return &types.EndpointUpdateRequest{
+		PluginName: string(types.PluginFile),
+		Timestamp:  time.Now(),
+		Endpoints:  endpoints,
+	}, nil
+}
+
+func (source *Source) Name() types.PluginType {
+	return types.PluginFile
+}
+
+func (source *Source) Updates() <-chan *types.EndpointUpdateRequest {
+	return source.updateRequestChannel
+}
+
+func (source *Source) Stop() {
+	source.cancel()
+}
+
+func (source *Source) Start() error {
+	log := logger.New("runFileRegistry")
+	defer log.LogDone()
+	appContext := source.ctx
+	changes := watcher.Watch(appContext, source.path, source.pollInterval)
+	updateRequestChannel := source.updateRequestChannel
+	go func(source *Source) {
+		defer close(updateRequestChannel)
+		for range changes {
+			updateRequest, err := source.getEndpointUpdateRequest()
+			if err != nil {
+				log.Warnf("skip %q because %s", source.path, err.Error())
+				continue
+			}
+			select {
+			case updateRequestChannel <- updateRequest:
+				log.Infof("sending update request with %v endpoints from %q", len(updateRequest.Endpoints), source.path)
+			case <-appContext.Done():
+				return
+			}
+		}
+	}(source)
+	return nil
+}
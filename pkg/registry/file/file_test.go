@@ -0,0 +1,151 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.Initialise(logger.NormalLogLevel)
+	os.Exit(m.Run())
+}
+
+const yamlDocument = `
+endpoints:
+  - clusterName: legacy
+    host: 192.168.1.20
+    port: 8080
+    urlPrefix: /api/legacy
+    version: v1.0.0
+  - clusterName: billing
+    host: 192.168.1.30
+    port: 9090
+`
+
+const jsonDocument = `{
+  "endpoints": [
+    {"clusterName": "legacy", "host": "192.168.1.20", "port": 8080, "urlPrefix": "/api/legacy", "version": "v1.0.0"},
+    {"clusterName": "billing", "host": "192.168.1.30", "port": 9090}
+  ]
+}`
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"endpoints.yaml", yamlDocument},
+		{"endpoints.json", jsonDocument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			writeFile(t, path, tc.content)
+			source := New(path, time.Second)
+			request, err := source.getEndpointUpdateRequest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if request.PluginName != string(types.PluginFile) {
+				t.Errorf("plugin name is %q", request.PluginName)
+			}
+			if len(request.Endpoints) != 2 {
+				t.Fatalf("expected 2 endpoints, got %v", len(request.Endpoints))
+			}
+			legacy := request.Endpoints[0]
+			if legacy.ClusterName != "legacy" || legacy.Host != "192.168.1.20" || legacy.Port != 8080 ||
+				legacy.FrontProxyPath != "/api/legacy" || legacy.Version != "v1.0.0" {
+				t.Errorf("unexpected endpoint %+v", legacy)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		endpoint fileEndpoint
+		valid    bool
+	}{
+		{"valid", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20", Port: 8080}, true},
+		{"missing cluster name", fileEndpoint{Host: "192.168.1.20", Port: 8080}, false},
+		{"missing host", fileEndpoint{ClusterName: "legacy", Port: 8080}, false},
+		{"zero port", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20"}, false},
+		{"port out of range", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20", Port: 70000}, false},
+		{"endpoint weight", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20", Port: 8080, EndpointWeight: 10000}, true},
+		{"endpoint weight too large", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20", Port: 8080, EndpointWeight: 10001}, false},
+		{"rewrite regex", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20", Port: 8080, RewriteRegex: "^/api/(v[0-9]+)/"}, true},
+		{"invalid rewrite regex", fileEndpoint{ClusterName: "legacy", Host: "192.168.1.20", Port: 8080, RewriteRegex: "^/api/(v[0-9]+/"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.endpoint.validate()
+			if tc.valid && err != nil {
+				t.Errorf("unexpected error %s", err.Error())
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestFrontProxyPathDefaultsToClusterName(t *testing.T) {
+	endpoint := fileEndpoint{ClusterName: "billing", Host: "192.168.1.30", Port: 9090}.mapToEndpoint()
+	if endpoint.FrontProxyPath != "/billing" {
+		t.Errorf("front proxy path is %q", endpoint.FrontProxyPath)
+	}
+	if endpoint.UniqueID != "billing/192.168.1.30:9090" {
+		t.Errorf("unique id is %q", endpoint.UniqueID)
+	}
+}
+
+func receive(t *testing.T, updates <-chan *types.EndpointUpdateRequest) *types.EndpointUpdateRequest {
+	t.Helper()
+	select {
+	case request, ok := <-updates:
+		if !ok {
+			t.Fatal("updates closed")
+		}
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+	return nil
+}
+
+func TestStartSendsUpdateWhenFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	writeFile(t, path, yamlDocument)
+	source := New(path, 10*time.Millisecond)
+	defer source.Stop()
+	if err := source.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if first := receive(t, source.Updates()); len(first.Endpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, got %v", len(first.Endpoints))
+	}
+
+	writeFile(t, path, `
+endpoints:
+  - clusterName: legacy
+    host: 192.168.1.21
+    port: 8080
+`)
+	second := receive(t, source.Updates())
+	if len(second.Endpoints) != 1 || second.Endpoints[0].Host != "192.168.1.21" {
+		t.Errorf("unexpected endpoints %+v", second.Endpoints)
+	}
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// Source is a discovery backend that publishes endpoint update requests
+type Source interface {
+	// Name identifies the source, it is also used as the PluginName of its update requests
+	Name() types.PluginType
+	// Start begins discovery, update requests are published on the Updates channel
+	Start() error
+	// Stop ends discovery and closes the Updates channel
+	Stop()
+	// Updates returns the channel on which update requests are published
+	Updates() <-chan *types.EndpointUpdateRequest
+}
+
+// Factory creates a new instance of a source
+type Factory func() (Source, error)
+
+var factories = make(map[types.PluginType]Factory)
+
+// Register makes a source available by name, it is expected to be called from the source package's init
+func Register(name types.PluginType, factory Factory) {
+	if factory == nil {
+		panic(fmt.Sprintf("registry: nil factory for %q", name))
+	}
+	if _, alreadyExist := factories[name]; alreadyExist {
+		panic(fmt.Sprintf("registry: %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names lists the registered sources
+func Names() []string {
+	var names []string
+	for name := range factories {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the source registered under name
+func New(name string) (Source, error) {
+	factory, exists := factories[types.PluginType(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown source %q, available sources are %s", name, strings.Join(Names(), ", "))
+	}
+	return factory()
+}
+
+// NewAll creates the sources for a comma separated list of names
+func NewAll(names string) ([]Source, error) {
+	var sources []Source
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) < 1 {
+			continue
+		}
+		source, err := New(name)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) < 1 {
+		return nil, fmt.Errorf("no source selected, available sources are %s", strings.Join(Names(), ", "))
+	}
+	return sources, nil
+}
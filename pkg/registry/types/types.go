@@ -1,7 +1,10 @@
 package types
 
 import (
+	"encoding/json"
+	"fmt"
 	"hash/fnv"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
@@ -10,9 +13,140 @@ import (
 type PluginType string
 
 const (
-	PluginDocker PluginType = "Docker"
+	PluginDocker      PluginType = "Docker"
+	PluginDockerSwarm PluginType = "DockerSwarm"
+	PluginFile        PluginType = "File"
+	PluginAggregate   PluginType = "Aggregate"
 )
 
+// HealthStatus is the health of an endpoint as reported by its source
+type HealthStatus string
+
+const (
+	HealthUnknown   HealthStatus = ""
+	HealthHealthy   HealthStatus = "Healthy"
+	HealthUnhealthy HealthStatus = "Unhealthy"
+	// HealthDraining endpoints are on their way out, they finish in-flight requests but receive no new ones
+	HealthDraining HealthStatus = "Draining"
+)
+
+// HealthCheckProtocol is how envoy actively checks the endpoints of a cluster
+type HealthCheckProtocol string
+
+const (
+	HealthCheckHTTP HealthCheckProtocol = "http"
+	HealthCheckTCP  HealthCheckProtocol = "tcp"
+	HealthCheckGRPC HealthCheckProtocol = "grpc"
+)
+
+// ParseHealthCheckProtocol accepts the protocol names in any case
+func ParseHealthCheckProtocol(value string) (HealthCheckProtocol, error) {
+	switch protocol := HealthCheckProtocol(strings.ToLower(strings.TrimSpace(value))); protocol {
+	case HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC:
+		return protocol, nil
+	}
+	return "", fmt.Errorf("unknown health check protocol %q, expecting %q, %q or %q", value, HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC)
+}
+
+// HealthCheck is envoy's active health check of a cluster, zero values are left to the defaults
+type HealthCheck struct {
+	Protocol           HealthCheckProtocol
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   uint32
+	UnhealthyThreshold uint32
+}
+
+// OutlierDetection ejects endpoints that keep failing, zero values are left to the defaults
+type OutlierDetection struct {
+	// Consecutive5xx is nil when not set, 0 turns outlier detection off
+	Consecutive5xx     *uint32
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionPercent uint32
+}
+
+// CircuitBreakers caps what envoy sends to a cluster at once, zero values are left to the defaults
+type CircuitBreakers struct {
+	MaxConnections     uint32
+	MaxPendingRequests uint32
+	MaxRequests        uint32
+	MaxRetries         uint32
+}
+
+// LbPolicy is how envoy picks an endpoint of a cluster
+type LbPolicy string
+
+const (
+	LbRoundRobin   LbPolicy = "round_robin"
+	LbLeastRequest LbPolicy = "least_request"
+	LbRandom       LbPolicy = "random"
+	// LbRingHash and LbMaglev are consistent hashing policies, requests with the same hash go to the same endpoint
+	LbRingHash LbPolicy = "ring_hash"
+	LbMaglev   LbPolicy = "maglev"
+)
+
+// ParseLbPolicy accepts the policy names in any case, with dashes or underscores
+func ParseLbPolicy(value string) (LbPolicy, error) {
+	switch policy := LbPolicy(strings.Replace(strings.ToLower(strings.TrimSpace(value)), "-", "_", -1)); policy {
+	case LbRoundRobin, LbLeastRequest, LbRandom, LbRingHash, LbMaglev:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown load balancing policy %q, expecting one of %q, %q, %q, %q or %q",
+		value, LbRoundRobin, LbLeastRequest, LbRandom, LbRingHash, LbMaglev)
+}
+
+// HashPolicyKind is what a request is hashed on
+type HashPolicyKind string
+
+const (
+	HashHeader   HashPolicyKind = "header"
+	HashCookie   HashPolicyKind = "cookie"
+	HashSourceIP HashPolicyKind = "source_ip"
+)
+
+// HashPolicy is what consistent hashing policies hash a request on, Name is the header or cookie name,
+// TTL is the lifetime of the cookie envoy sets when the request has none, zero makes it a session cookie
+type HashPolicy struct {
+	Kind HashPolicyKind
+	Name string
+	TTL  time.Duration
+}
+
+// ParseHashPolicy reads header:<name>, cookie:<name>[:<ttl>] or source_ip
+func ParseHashPolicy(value string) (HashPolicy, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	switch kind := HashPolicyKind(strings.ToLower(parts[0])); {
+	case kind == HashSourceIP && len(parts) == 1:
+		return HashPolicy{Kind: kind}, nil
+	case kind == HashHeader && len(parts) == 2 && len(parts[1]) > 0:
+		return HashPolicy{Kind: kind, Name: parts[1]}, nil
+	case kind == HashCookie && (len(parts) == 2 || len(parts) == 3) && len(parts[1]) > 0:
+		hashPolicy := HashPolicy{Kind: kind, Name: parts[1]}
+		if len(parts) == 3 {
+			ttl, err := time.ParseDuration(parts[2])
+			if err != nil {
+				return HashPolicy{}, fmt.Errorf("invalid cookie ttl in hash policy %q, %s", value, err.Error())
+			}
+			hashPolicy.TTL = ttl
+		}
+		return hashPolicy, nil
+	}
+	return HashPolicy{}, fmt.Errorf("unknown hash policy %q, expecting header:<name>, cookie:<name>[:<ttl>] or source_ip", value)
+}
+
+// RetryPolicy retries failed requests, there are no retries when RetryOn is empty
+type RetryPolicy struct {
+	// RetryOn is a comma separated list of envoy retry conditions, e.g. 5xx,connect-failure
+	RetryOn       string
+	NumRetries    uint32
+	PerTryTimeout time.Duration
+}
+
+// MaxEndpointWeight caps endpoint weights, envoy rejects endpoints whose weights add up to more than a uint32
+const MaxEndpointWeight = 10000
+
 // Endpoint represent the service endpoint
 type Endpoint struct {
 	UniqueID       string
@@ -21,6 +155,50 @@ type Endpoint struct {
 	Host           string
 	FrontProxyPath string
 	Version        string
+	Health         HealthStatus
+	// Created is when the container or task behind the endpoint was created, it is zero when the source does not know
+	Created time.Time
+	// HealthCheck makes envoy probe the cluster's endpoints, there is no active health check when nil
+	HealthCheck      *HealthCheck
+	OutlierDetection OutlierDetection
+	CircuitBreakers  CircuitBreakers
+	// LbPolicy is round robin when empty
+	LbPolicy LbPolicy
+	// HashPolicies are used in turn until one of them gives a hash
+	HashPolicies []HashPolicy
+	// EndpointWeight is the endpoint's share of its cluster's traffic relative to the other endpoints, envoy's default of 1 is used when 0,
+	// it is at most MaxEndpointWeight
+	EndpointWeight uint32
+	// Timeout is the whole request's timeout, 0 turns it off and nil leaves envoy's default of 15s
+	Timeout *time.Duration
+	// IdleTimeout is how long a request may go without activity, 0 turns it off and nil leaves envoy's default
+	IdleTimeout *time.Duration
+	RetryPolicy RetryPolicy
+	// VersionWeight is the share of the cluster's traffic sent to the endpoint's version, nil when not labelled
+	VersionWeight *uint32
+	// RoutePriority puts the cluster's routes ahead of routes with a lower priority, whatever their prefix length
+	RoutePriority int
+	// Rewrite replaces the front proxy path before forwarding, or is the substitution when RewriteRegex is set
+	Rewrite string
+	// RewriteRegex is a pattern replaced in the path by Rewrite before forwarding
+	RewriteRegex string
+	// Domains are the host names the cluster is served on, the default domain is used when empty
+	Domains []string
+	// NodeGroups limits the envoy node groups that see the endpoint, all groups see it when empty
+	NodeGroups []string
+}
+
+// IsVisibleTo indicates whether the endpoint is meant for a node group
+func (endpoint Endpoint) IsVisibleTo(nodeGroup string) bool {
+	if len(endpoint.NodeGroups) < 1 {
+		return true
+	}
+	for _, group := range endpoint.NodeGroups {
+		if group == nodeGroup {
+			return true
+		}
+	}
+	return false
 }
 
 // EndpointUpdateRequest represent the update request
@@ -36,14 +214,38 @@ func hash(s string) uint32 {
 	return h.Sum32()
 }
 
-// GetHash provide an indication if endpoints are the same from another set of endpoints
+func (endpoint Endpoint) key() string {
+	return fmt.Sprintf("%s|%s|%v", endpoint.ClusterName, endpoint.UniqueID, endpoint.Port)
+}
+
+func sortEndpoints(endpoints []Endpoint) []Endpoint {
+	sorted := append([]Endpoint{}, endpoints...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].key() < sorted[j].key()
+	})
+	return sorted
+}
+
+// GetHash provide an indication if endpoints are the same from another set of endpoints, every field of every endpoint is taken into account
 func (request *EndpointUpdateRequest) GetHash() uint32 {
-	var ids []string
-	for _, endpoint := range request.Endpoints {
-		ids = append(ids, endpoint.UniqueID)
+	content, err := json.Marshal(sortEndpoints(request.Endpoints))
+	if err != nil {
+		panic(err)
 	}
-	sort.Strings(ids)
-	return hash(strings.Join(ids, ""))
+	return hash(string(content))
+}
+
+// FilterByNodeGroup keeps the endpoints visible to a node group, clusters left without endpoints are dropped
+func FilterByNodeGroup(clusterEndpoints map[string][]Endpoint, nodeGroup string) map[string][]Endpoint {
+	filtered := make(map[string][]Endpoint)
+	for clusterName, endpoints := range clusterEndpoints {
+		for _, endpoint := range endpoints {
+			if endpoint.IsVisibleTo(nodeGroup) {
+				filtered[clusterName] = append(filtered[clusterName], endpoint)
+			}
+		}
+	}
+	return filtered
 }
 
 func (request *EndpointUpdateRequest) GroupByCluster() map[string][]Endpoint {
@@ -58,3 +260,82 @@ func (request *EndpointUpdateRequest) GroupByCluster() map[string][]Endpoint {
 	}
 	return clusters
 }
+
+// EndpointChange is an endpoint whose details differ between two updates
+type EndpointChange struct {
+	Previous Endpoint
+	Current  Endpoint
+}
+
+// ClusterDiff lists the endpoint differences of a cluster between two updates
+type ClusterDiff struct {
+	Added   []Endpoint
+	Removed []Endpoint
+	Changed []EndpointChange
+}
+
+func (diff ClusterDiff) isEmpty() bool {
+	return len(diff.Added) < 1 && len(diff.Removed) < 1 && len(diff.Changed) < 1
+}
+
+func describe(endpoint Endpoint) string {
+	return fmt.Sprintf("%s(%s:%v)", endpoint.UniqueID, endpoint.Host, endpoint.Port)
+}
+
+func (diff ClusterDiff) String() string {
+	var parts []string
+	for _, endpoint := range diff.Added {
+		parts = append(parts, "+"+describe(endpoint))
+	}
+	for _, endpoint := range diff.Removed {
+		parts = append(parts, "-"+describe(endpoint))
+	}
+	for _, change := range diff.Changed {
+		parts = append(parts, fmt.Sprintf("~%s->%s", describe(change.Previous), describe(change.Current)))
+	}
+	return strings.Join(parts, " ")
+}
+
+func keyEndpoints(endpoints []Endpoint) map[string]Endpoint {
+	keyed := make(map[string]Endpoint)
+	for _, endpoint := range endpoints {
+		keyed[endpoint.key()] = endpoint
+	}
+	return keyed
+}
+
+// Diff compares the endpoints of every cluster, only clusters with differences are returned
+func Diff(previous map[string][]Endpoint, current map[string][]Endpoint) map[string]ClusterDiff {
+	clusterNames := make(map[string]bool)
+	for clusterName := range previous {
+		clusterNames[clusterName] = true
+	}
+	for clusterName := range current {
+		clusterNames[clusterName] = true
+	}
+	diffs := make(map[string]ClusterDiff)
+	for clusterName := range clusterNames {
+		previousEndpoints := keyEndpoints(previous[clusterName])
+		var diff ClusterDiff
+		for _, endpoint := range sortEndpoints(current[clusterName]) {
+			previousEndpoint, existed := previousEndpoints[endpoint.key()]
+			if !existed {
+				diff.Added = append(diff.Added, endpoint)
+				continue
+			}
+			if !reflect.DeepEqual(previousEndpoint, endpoint) {
+				diff.Changed = append(diff.Changed, EndpointChange{Previous: previousEndpoint, Current: endpoint})
+			}
+		}
+		currentEndpoints := keyEndpoints(current[clusterName])
+		for _, endpoint := range sortEndpoints(previous[clusterName]) {
+			if _, exists := currentEndpoints[endpoint.key()]; !exists {
+				diff.Removed = append(diff.Removed, endpoint)
+			}
+		}
+		if !diff.isEmpty() {
+			diffs[clusterName] = diff
+		}
+	}
+	return diffs
+}
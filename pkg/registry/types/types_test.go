@@ -0,0 +1,39 @@
+package types
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFilterByNodeGroup(t *testing.T) {
+	clusterEndpoints := map[string][]Endpoint{
+		"shared": {{UniqueID: "s1"}, {UniqueID: "s2", NodeGroups: []string{}}},
+		"public": {{UniqueID: "p1", NodeGroups: []string{"edge"}}},
+		"mixed": {
+			{UniqueID: "m1", NodeGroups: []string{"edge", "internal"}},
+			{UniqueID: "m2", NodeGroups: []string{"internal"}},
+		},
+	}
+	for _, tc := range []struct {
+		nodeGroup string
+		visible   map[string][]string
+	}{
+		{"edge", map[string][]string{"shared": {"s1", "s2"}, "public": {"p1"}, "mixed": {"m1"}}},
+		{"internal", map[string][]string{"shared": {"s1", "s2"}, "mixed": {"m1", "m2"}}},
+		{"other", map[string][]string{"shared": {"s1", "s2"}}},
+	} {
+		t.Run(tc.nodeGroup, func(t *testing.T) {
+			visible := make(map[string][]string)
+			for clusterName, endpoints := range FilterByNodeGroup(clusterEndpoints, tc.nodeGroup) {
+				for _, endpoint := range endpoints {
+					visible[clusterName] = append(visible[clusterName], endpoint.UniqueID)
+				}
+				sort.Strings(visible[clusterName])
+			}
+			if !reflect.DeepEqual(visible, tc.visible) {
+				t.Errorf("visible endpoints are %v, expecting %v", visible, tc.visible)
+			}
+		})
+	}
+}
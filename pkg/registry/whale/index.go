@@ -0,0 +1,231 @@
+package whale
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dTypes "github.com/docker/docker/api/types"
+	dContainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	dClient "github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// indexedContainer is a running discoverable container with the details a container listing leaves out
+type indexedContainer struct {
+	container dTypes.Container
+	health    types.HealthStatus
+	draining  bool
+	// drained is set once the drain period is over, died once the draining container is gone,
+	// the container is removed when both are set
+	drained bool
+	died    bool
+	// cpus is the container's CPU limit, 0 when it has none
+	cpus float64
+	// stopSignal is the number of the signal docker stops the container with
+	stopSignal int
+}
+
+const (
+	sigKill = 9
+	sigTerm = 15
+)
+
+// signalNumbers are the linux numbers of the signals a container can be configured to stop with, kill events report numbers
+var signalNumbers = map[string]int{
+	"HUP":   1,
+	"INT":   2,
+	"QUIT":  3,
+	"KILL":  sigKill,
+	"USR1":  10,
+	"USR2":  12,
+	"TERM":  sigTerm,
+	"STOP":  19,
+	"WINCH": 28,
+	"PWR":   30,
+}
+
+// parseSignal reads a signal given by number, e.g. "15", or by name, e.g. "SIGTERM" or "TERM"
+func parseSignal(value string) (int, bool) {
+	if number, err := strconv.Atoi(value); err == nil {
+		return number, number > 0
+	}
+	number, found := signalNumbers[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "SIG")]
+	return number, found
+}
+
+// getStopSignal is the signal configured with --stop-signal or STOPSIGNAL, docker defaults to SIGTERM
+func getStopSignal(config *dContainer.Config) int {
+	if config == nil || len(config.StopSignal) < 1 {
+		return sigTerm
+	}
+	if number, valid := parseSignal(config.StopSignal); valid {
+		return number
+	}
+	return sigTerm
+}
+
+// isStopping tells whether a kill signal stops the container gracefully, SIGKILL leaves no time to drain
+// and other signals, e.g. SIGHUP to reload, keep the container running
+func (container indexedContainer) isStopping(signal string) bool {
+	number, valid := parseSignal(signal)
+	if !valid || number == sigKill {
+		return false
+	}
+	return number == sigTerm || number == container.stopSignal
+}
+
+// containerIndex holds the running discoverable containers keyed by container ID
+type containerIndex map[string]indexedContainer
+
+// mapDockerHealth converts docker's health check status, containers without a health check have an unknown status
+func mapDockerHealth(state *dTypes.ContainerState) types.HealthStatus {
+	if state == nil || state.Health == nil {
+		return types.HealthUnknown
+	}
+	switch state.Health.Status {
+	case dTypes.Healthy:
+		return types.HealthHealthy
+	case dTypes.Starting, dTypes.Unhealthy:
+		return types.HealthUnhealthy
+	}
+	return types.HealthUnknown
+}
+
+func mapPortMapToPorts(portMap nat.PortMap) []dTypes.Port {
+	var ports []dTypes.Port
+	for port, bindings := range portMap {
+		privatePort := uint16(port.Int())
+		if len(bindings) < 1 {
+			ports = append(ports, dTypes.Port{PrivatePort: privatePort, Type: port.Proto()})
+			continue
+		}
+		for _, binding := range bindings {
+			publicPort, _ := strconv.Atoi(binding.HostPort)
+			ports = append(ports, dTypes.Port{
+				IP:          binding.HostIP,
+				PrivatePort: privatePort,
+				PublicPort:  uint16(publicPort),
+				Type:        port.Proto(),
+			})
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].PrivatePort != ports[j].PrivatePort {
+			return ports[i].PrivatePort < ports[j].PrivatePort
+		}
+		return ports[i].IP < ports[j].IP
+	})
+	return ports
+}
+
+// mapInspectToContainer converts inspection details into the same shape returned by a container listing
+func mapInspectToContainer(inspected dTypes.ContainerJSON) dTypes.Container {
+	container := dTypes.Container{
+		ID:    inspected.ID,
+		Names: []string{inspected.Name},
+	}
+	if created, err := time.Parse(time.RFC3339Nano, inspected.Created); err == nil {
+		container.Created = created.Unix()
+	}
+	if inspected.State != nil {
+		container.State = inspected.State.Status
+	}
+	if inspected.Config != nil {
+		container.Image = inspected.Config.Image
+		container.Labels = inspected.Config.Labels
+	}
+	if inspected.HostConfig != nil {
+		container.HostConfig.NetworkMode = string(inspected.HostConfig.NetworkMode)
+	}
+	if inspected.NetworkSettings != nil {
+		container.Ports = mapPortMapToPorts(inspected.NetworkSettings.Ports)
+		container.NetworkSettings = &dTypes.SummaryNetworkSettings{
+			Networks: inspected.NetworkSettings.Networks,
+		}
+	}
+	return container
+}
+
+// getCPULimit reads the CPU limit set with --cpus, or with --cpu-quota and --cpu-period
+func getCPULimit(hostConfig *dContainer.HostConfig) float64 {
+	if hostConfig == nil {
+		return 0
+	}
+	if hostConfig.NanoCPUs > 0 {
+		return float64(hostConfig.NanoCPUs) / 1e9
+	}
+	if hostConfig.CPUQuota > 0 && hostConfig.CPUPeriod > 0 {
+		return float64(hostConfig.CPUQuota) / float64(hostConfig.CPUPeriod)
+	}
+	return 0
+}
+
+// inspect fetches a discoverable running container, nil is returned when the container is gone, stopped or not discoverable
+func inspect(appContext context.Context, api *dClient.Client, containerID string) (*indexedContainer, error) {
+	inspected, err := api.ContainerInspect(appContext, containerID)
+	if err != nil {
+		if dClient.IsErrContainerNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if inspected.State == nil || !inspected.State.Running {
+		return nil, nil
+	}
+	container := mapInspectToContainer(inspected)
+	if len(getServicePorts(container.Labels)) < 1 {
+		return nil, nil
+	}
+	return &indexedContainer{
+		container:  container,
+		health:     mapDockerHealth(inspected.State),
+		cpus:       getCPULimit(inspected.HostConfig),
+		stopSignal: getStopSignal(inspected.Config),
+	}, nil
+}
+
+// seedIndex lists every running container and inspects the discoverable ones
+func seedIndex(appContext context.Context, api *dClient.Client) (containerIndex, error) {
+	log := logger.New("seedIndex")
+	defer log.LogDone()
+	containerFilters := filters.NewArgs()
+	containerFilters.Add("status", "running")
+	containers, err := api.ContainerList(appContext, dTypes.ContainerListOptions{
+		Filters: containerFilters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := make(containerIndex)
+	for _, listed := range containers {
+		if len(getServicePorts(listed.Labels)) < 1 {
+			continue
+		}
+		container, err := inspect(appContext, api, listed.ID)
+		if err != nil {
+			return nil, err
+		}
+		if container != nil {
+			index[listed.ID] = *container
+		}
+	}
+	log.Infof("indexed %v discoverable containers out of %v running containers", len(index), len(containers))
+	return index, nil
+}
+
+func (index containerIndex) containers() []indexedContainer {
+	var containers []indexedContainer
+	for _, container := range index {
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].container.ID < containers[j].container.ID
+	})
+	return containers
+}
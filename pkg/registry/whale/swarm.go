@@ -0,0 +1,231 @@
+package whale
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	dTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	dClient "github.com/docker/docker/client"
+	"github.com/kahgeh/whale-disco/pkg/ctx"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+const ingressNetworkName = "ingress"
+
+var swarmPollInterval time.Duration
+
+// SwarmSession provides configuration source from swarm services and their tasks
+type SwarmSession struct {
+	api                  *dClient.Client
+	pollInterval         time.Duration
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	updateRequestChannel chan *types.EndpointUpdateRequest
+}
+
+func init() {
+	flag.DurationVar(&swarmPollInterval, "swarmPollInterval", 5*time.Second, "how often swarm services are listed, used by the DockerSwarm source")
+	registry.Register(types.PluginDockerSwarm, func() (registry.Source, error) {
+		return NewSwarm(swarmPollInterval)
+	})
+}
+
+func NewSwarm(pollInterval time.Duration) (*SwarmSession, error) {
+	log := logger.New("connectToSwarm")
+	defer log.LogDone()
+	dockerApi, err := dClient.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	sessionCtx, cancel := context.WithCancel(ctx.GetContext())
+	return &SwarmSession{
+		api:                  dockerApi,
+		pollInterval:         pollInterval,
+		ctx:                  sessionCtx,
+		cancel:               cancel,
+		updateRequestChannel: make(chan *types.EndpointUpdateRequest),
+	}, nil
+}
+
+// getServiceLabels combines container labels with service labels, service labels take precedence
+func getServiceLabels(service swarm.Service) map[string]string {
+	labels := make(map[string]string)
+	for key, value := range service.Spec.TaskTemplate.ContainerSpec.Labels {
+		labels[key] = value
+	}
+	for key, value := range service.Spec.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+func getAttachmentAddress(attachment swarm.NetworkAttachment) string {
+	for _, address := range attachment.Addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			ip = net.ParseIP(address)
+		}
+		if ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// getTaskAddress picks the task's address on the preferred network, otherwise on an overlay network, the ingress network is only used as a last resort
+func getTaskAddress(task swarm.Task, labels map[string]string) string {
+	for _, name := range getNetworkPreferences(labels) {
+		for _, attachment := range task.NetworksAttachments {
+			if attachment.Network.Spec.Name != name {
+				continue
+			}
+			if address := getAttachmentAddress(attachment); len(address) > 0 {
+				return address
+			}
+		}
+	}
+	attachments := append([]swarm.NetworkAttachment{}, task.NetworksAttachments...)
+	sort.SliceStable(attachments, func(i, j int) bool {
+		iIngress := attachments[i].Network.Spec.Name == ingressNetworkName
+		jIngress := attachments[j].Network.Spec.Name == ingressNetworkName
+		if iIngress != jIngress {
+			return jIngress
+		}
+		return attachments[i].Network.Spec.Name < attachments[j].Network.Spec.Name
+	})
+	for _, attachment := range attachments {
+		if address := getAttachmentAddress(attachment); len(address) > 0 {
+			return address
+		}
+	}
+	return ""
+}
+
+// getTaskCPULimit reads the task's CPU limit, 0 when it has none
+func getTaskCPULimit(task swarm.Task) float64 {
+	resources := task.Spec.Resources
+	if resources == nil || resources.Limits == nil {
+		return 0
+	}
+	return float64(resources.Limits.NanoCPUs) / 1e9
+}
+
+func (session *SwarmSession) getServiceEndpoints(swarmService swarm.Service, labels map[string]string, services []service) ([]types.Endpoint, error) {
+	log := logger.New("getServiceEndpoints")
+	defer log.LogDone()
+	taskFilters := filters.NewArgs()
+	taskFilters.Add("service", swarmService.ID)
+	taskFilters.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := session.api.TaskList(session.ctx, dTypes.TaskListOptions{
+		Filters: taskFilters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []types.Endpoint
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		host := getTaskAddress(task, labels)
+		if len(host) < 1 {
+			log.Warnf("skip task %q of service %q, it has no network address", task.ID, swarmService.Spec.Name)
+			continue
+		}
+		for _, service := range services {
+			endpoints = append(endpoints,
+				service.mapToEndpoint(task.ID, host, service.port, task.CreatedAt, getTaskCPULimit(task)))
+		}
+	}
+	return endpoints, nil
+}
+
+func (session *SwarmSession) getEndpointUpdateRequest() *types.EndpointUpdateRequest {
+	log := logger.New("getSwarmUpdateRequest")
+	defer log.LogDone()
+	swarmServices, err := session.api.ServiceList(session.ctx, dTypes.ServiceListOptions{})
+	if err != nil {
+		log.Warnf("error listing services, %s", err.Error())
+		return nil
+	}
+
+	var endpoints []types.Endpoint
+	for _, swarmService := range swarmServices {
+		labels := getServiceLabels(swarmService)
+		servicePorts := getServicePorts(labels)
+		if len(servicePorts) < 1 {
+			continue
+		}
+		serviceEndpoints, err := session.getServiceEndpoints(swarmService, labels, mapLabelsToServices(labels, servicePorts))
+		if err != nil {
+			log.Warnf("error listing tasks of service %q, %s", swarmService.Spec.Name, err.Error())
+			return nil
+		}
+		endpoints = append(endpoints, serviceEndpoints...)
+	}
+
+	return &types.EndpointUpdateRequest{
+		PluginName: string(types.PluginDockerSwarm),
+		Timestamp:  time.Now(),
+		Endpoints:  endpoints,
+	}
+}
+
+func (session *SwarmSession) Name() types.PluginType {
+	return types.PluginDockerSwarm
+}
+
+func (session *SwarmSession) Updates() <-chan *types.EndpointUpdateRequest {
+	return session.updateRequestChannel
+}
+
+func (session *SwarmSession) Stop() {
+	session.cancel()
+}
+
+func (session *SwarmSession) Start() error {
+	log := logger.New("runSwarmRegistry")
+	defer log.LogDone()
+	appContext := session.ctx
+	info, err := session.api.Info(appContext)
+	if err != nil {
+		return err
+	}
+	if !info.Swarm.ControlAvailable {
+		return fmt.Errorf("swarm services can only be listed on a manager node, this node is %q", info.Swarm.LocalNodeState)
+	}
+	updateRequestChannel := session.updateRequestChannel
+	go func(session *SwarmSession) {
+		defer close(updateRequestChannel)
+		var previousHash uint32
+		sent := false
+		for {
+			updateRequest := session.getEndpointUpdateRequest()
+			if updateRequest != nil && (!sent || updateRequest.GetHash() != previousHash) {
+				select {
+				case updateRequestChannel <- updateRequest:
+					log.Infof("sending update request with %v endpoints", len(updateRequest.Endpoints))
+				case <-appContext.Done():
+					return
+				}
+				previousHash = updateRequest.GetHash()
+				sent = true
+			}
+			select {
+			case <-time.After(session.pollInterval):
+			case <-appContext.Done():
+				log.Info("terminating swarm scanner loop")
+				return
+			}
+		}
+	}(session)
+	return nil
+}
@@ -0,0 +1,216 @@
+package whale
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	dTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	dClient "github.com/docker/docker/client"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.Initialise(logger.NormalLogLevel)
+	os.Exit(m.Run())
+}
+
+// fakeSwarm is a docker API serving a fixed set of swarm services and tasks
+type fakeSwarm struct {
+	services []swarm.Service
+	tasks    []swarm.Task
+}
+
+func (fake *fakeSwarm) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// strip the API version, e.g. /v1.25/services
+	path := request.URL.Path
+	if parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2); len(parts) == 2 && strings.HasPrefix(parts[0], "v") {
+		path = "/" + parts[1]
+	}
+	var body interface{}
+	switch path {
+	case "/info":
+		body = dTypes.Info{Swarm: swarm.Info{LocalNodeState: swarm.LocalNodeStateActive, ControlAvailable: true}}
+	case "/services":
+		body = fake.services
+	case "/tasks":
+		args, err := filters.FromParam(request.URL.Query().Get("filters"))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tasks := []swarm.Task{}
+		for _, task := range fake.tasks {
+			if args.ExactMatch("service", task.ServiceID) {
+				tasks = append(tasks, task)
+			}
+		}
+		body = tasks
+	default:
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(body)
+}
+
+func newFakeSwarmSession(t *testing.T, fake *fakeSwarm) *SwarmSession {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	api, err := dClient.NewClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), "1.25", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &SwarmSession{
+		api:                  api,
+		pollInterval:         time.Hour,
+		ctx:                  sessionCtx,
+		cancel:               cancel,
+		updateRequestChannel: make(chan *types.EndpointUpdateRequest),
+	}
+}
+
+func newService(id string, serviceLabels map[string]string, containerLabels map[string]string) swarm.Service {
+	service := swarm.Service{ID: id}
+	service.Spec.Name = id
+	service.Spec.Labels = serviceLabels
+	service.Spec.TaskTemplate.ContainerSpec.Labels = containerLabels
+	return service
+}
+
+func newAttachment(networkName string, address string) swarm.NetworkAttachment {
+	attachment := swarm.NetworkAttachment{Addresses: []string{address}}
+	attachment.Network.Spec.Name = networkName
+	return attachment
+}
+
+func newTask(id string, serviceID string, state swarm.TaskState, attachments ...swarm.NetworkAttachment) swarm.Task {
+	return swarm.Task{
+		ID:                  id,
+		ServiceID:           serviceID,
+		Status:              swarm.TaskStatus{State: state},
+		NetworksAttachments: attachments,
+	}
+}
+
+func getSwarmEndpoints(t *testing.T, fake *fakeSwarm) map[string]types.Endpoint {
+	t.Helper()
+	request := newFakeSwarmSession(t, fake).getEndpointUpdateRequest()
+	if request == nil {
+		t.Fatal("no update request")
+	}
+	endpoints := make(map[string]types.Endpoint)
+	for _, endpoint := range request.Endpoints {
+		endpoints[endpoint.UniqueID] = endpoint
+	}
+	return endpoints
+}
+
+func TestSwarmServiceLabelsTakePrecedence(t *testing.T) {
+	endpoints := getSwarmEndpoints(t, &fakeSwarm{
+		services: []swarm.Service{newService("api",
+			map[string]string{"CLUSTER_80_NAME": "from-service"},
+			map[string]string{"CLUSTER_80_NAME": "from-container", "CLUSTER_80_URLPREFIX": "/api/v1"})},
+		tasks: []swarm.Task{newTask("task1", "api", swarm.TaskStateRunning, newAttachment("backend", "10.0.1.5/24"))},
+	})
+	endpoint, found := endpoints["task1"]
+	if !found {
+		t.Fatalf("task1 missing from %+v", endpoints)
+	}
+	if endpoint.ClusterName != "from-service" {
+		t.Errorf("cluster name is %q", endpoint.ClusterName)
+	}
+	if endpoint.FrontProxyPath != "/api/v1" {
+		t.Errorf("container labels the service does not override are lost, front proxy path is %q", endpoint.FrontProxyPath)
+	}
+	if endpoint.Host != "10.0.1.5" || endpoint.Port != 80 {
+		t.Errorf("address is %s:%v", endpoint.Host, endpoint.Port)
+	}
+}
+
+func TestSwarmTaskAddress(t *testing.T) {
+	labels := map[string]string{"CLUSTER_80_NAME": "api", networkLabelKey: "backend"}
+	endpoints := getSwarmEndpoints(t, &fakeSwarm{
+		services: []swarm.Service{newService("api", labels, nil)},
+		tasks: []swarm.Task{
+			newTask("preferred", "api", swarm.TaskStateRunning,
+				newAttachment("ingress", "10.255.0.5/16"),
+				newAttachment("frontend", "10.0.2.5/24"),
+				newAttachment("backend", "10.0.1.5/24")),
+			newTask("overlay", "api", swarm.TaskStateRunning,
+				newAttachment("ingress", "10.255.0.6/16"),
+				newAttachment("frontend", "10.0.2.6/24")),
+			newTask("ingressOnly", "api", swarm.TaskStateRunning,
+				newAttachment("ingress", "10.255.0.7/16")),
+			newTask("noAddress", "api", swarm.TaskStateRunning),
+		},
+	})
+	for taskID, expected := range map[string]string{
+		"preferred":   "10.0.1.5",
+		"overlay":     "10.0.2.6",
+		"ingressOnly": "10.255.0.7",
+	} {
+		endpoint, found := endpoints[taskID]
+		if !found {
+			t.Errorf("%s missing", taskID)
+			continue
+		}
+		if endpoint.Host != expected {
+			t.Errorf("%s address is %q, expecting %q", taskID, endpoint.Host, expected)
+		}
+	}
+	if _, found := endpoints["noAddress"]; found {
+		t.Error("task without an address is discovered")
+	}
+}
+
+func TestSwarmSkipsTasksThatAreNotRunning(t *testing.T) {
+	labels := map[string]string{"CLUSTER_80_NAME": "api"}
+	endpoints := getSwarmEndpoints(t, &fakeSwarm{
+		services: []swarm.Service{
+			newService("api", labels, nil),
+			newService("undiscoverable", nil, nil),
+		},
+		tasks: []swarm.Task{
+			newTask("running", "api", swarm.TaskStateRunning, newAttachment("overlay", "10.0.1.5/24")),
+			newTask("starting", "api", swarm.TaskStateStarting, newAttachment("overlay", "10.0.1.6/24")),
+			newTask("shutdown", "api", swarm.TaskStateShutdown, newAttachment("overlay", "10.0.1.7/24")),
+			newTask("unlabelled", "undiscoverable", swarm.TaskStateRunning, newAttachment("overlay", "10.0.1.8/24")),
+		},
+	})
+	if len(endpoints) != 1 {
+		t.Fatalf("expecting only the running task, got %+v", endpoints)
+	}
+	if _, found := endpoints["running"]; !found {
+		t.Errorf("running task missing from %+v", endpoints)
+	}
+}
+
+func TestSwarmStartPublishesEndpoints(t *testing.T) {
+	session := newFakeSwarmSession(t, &fakeSwarm{
+		services: []swarm.Service{newService("api", map[string]string{"CLUSTER_80_NAME": "api"}, nil)},
+		tasks:    []swarm.Task{newTask("task1", "api", swarm.TaskStateRunning, newAttachment("overlay", "10.0.1.5/24"))},
+	})
+	if err := session.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case request := <-session.Updates():
+		if len(request.Endpoints) != 1 || request.PluginName != string(types.PluginDockerSwarm) {
+			t.Errorf("unexpected update %+v", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+}
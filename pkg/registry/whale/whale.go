@@ -1,26 +1,38 @@
 package whale
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	dTypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 	dClient "github.com/docker/docker/client"
 	"github.com/kahgeh/whale-disco/pkg/ctx"
 
 	"github.com/docker/docker/api/types/filters"
 	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry"
 	"github.com/kahgeh/whale-disco/pkg/registry/types"
 )
 
-// Docker provides configuration source from whale
+// Session provides configuration source from whale
 type Session struct {
-	api *dClient.Client
+	api                  *dClient.Client
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	updateRequestChannel chan *types.EndpointUpdateRequest
+	containers           containerIndex
+	drainedChannel       chan string
 }
 
 type enPorts []dTypes.Port
@@ -28,18 +40,77 @@ type enPorts []dTypes.Port
 type ContainerEvent string
 
 const (
-	EventStart ContainerEvent = "start"
-	EventDie   ContainerEvent = "die"
+	EventStart        ContainerEvent = "start"
+	EventDie          ContainerEvent = "die"
+	EventHealthStatus ContainerEvent = "health_status"
+	EventRename       ContainerEvent = "rename"
+	EventKill         ContainerEvent = "kill"
+	EventStop         ContainerEvent = "stop"
+	// EventConnect and EventDisconnect are network events, they change the addresses of a container
+	EventConnect    ContainerEvent = "connect"
+	EventDisconnect ContainerEvent = "disconnect"
+)
+
+type HealthMode string
+
+const (
+	// HealthReport passes docker's health check status on to envoy
+	HealthReport HealthMode = "report"
+	// HealthOmit leaves out containers that are starting or unhealthy
+	HealthOmit HealthMode = "omit"
+	// HealthIgnore treats every running container as available
+	HealthIgnore HealthMode = "ignore"
+)
+
+type AddressingMode string
+
+const (
+	// AddressingContainer uses the container's IP address and port, envoy has to be able to reach the container network
+	AddressingContainer AddressingMode = "container"
+	// AddressingPublished uses the host address and the port published on the host
+	AddressingPublished AddressingMode = "published"
+)
+
+const (
+	commitIDKey        = "COMMIT_ID"
+	versionKey         = "VERSION"
+	networkLabelKey    = "WHALE_DISCO_NETWORK"
+	addressingLabelKey = "WHALE_DISCO_ADDRESSING"
 )
 
 const (
-	commitIDKey = "COMMIT_ID"
-	versionKey  = "VERSION"
+	cpuWeightPerCPU    = 10
+	defaultRetryOn     = "5xx"
+	defaultNetworkName = "bridge"
+	hostNetworkMode    = "host"
+)
+
+var (
+	preferredNetworkName string
+	addressingMode       string
+	hostAddress          string
+	healthMode           string
+	drainPeriod          time.Duration
+	cpuWeight            bool
 )
 
 var (
 	portGroupExpr      = "(?P<port>\\d+)"
 	urlPrefixExpr      = fmt.Sprintf("CLUSTER_%s_URLPREFIX", portGroupExpr)
+	nodeGroupsExpr     = fmt.Sprintf("CLUSTER_%s_NODE_GROUPS", portGroupExpr)
+	domainsExpr        = fmt.Sprintf("CLUSTER_%s_DOMAINS", portGroupExpr)
+	rewriteExpr        = fmt.Sprintf("CLUSTER_%s_REWRITE", portGroupExpr)
+	priorityExpr       = fmt.Sprintf("CLUSTER_%s_PRIORITY", portGroupExpr)
+	weightExpr         = fmt.Sprintf("CLUSTER_%s_WEIGHT", portGroupExpr)
+	healthCheckExpr    = fmt.Sprintf("CLUSTER_%s_HEALTHCHECK", portGroupExpr)
+	outlierExpr        = fmt.Sprintf("CLUSTER_%s_OUTLIER", portGroupExpr)
+	lbPolicyExpr       = fmt.Sprintf("CLUSTER_%s_LB_POLICY", portGroupExpr)
+	hashPolicyExpr     = fmt.Sprintf("CLUSTER_%s_HASH_POLICY", portGroupExpr)
+	endpointWeightExpr = fmt.Sprintf("CLUSTER_%s_ENDPOINT_WEIGHT", portGroupExpr)
+	timeoutExpr        = fmt.Sprintf("CLUSTER_%s_TIMEOUT", portGroupExpr)
+	idleTimeoutExpr    = fmt.Sprintf("CLUSTER_%s_IDLE_TIMEOUT", portGroupExpr)
+	clusterExpr        = fmt.Sprintf("CLUSTER_%s", portGroupExpr)
+	rewriteRegexExpr   = fmt.Sprintf("CLUSTER_%s_REWRITE_REGEX", portGroupExpr)
 	serviceNameExpr    = fmt.Sprintf("CLUSTER_%s_NAME", portGroupExpr)
 	serviceNamePattern = regexp.MustCompile(serviceNameExpr)
 )
@@ -50,16 +121,35 @@ var (
 )
 
 type service struct {
-	name      string
-	urlPrefix string
-	version   string
-	port      uint16
+	name         string
+	urlPrefix    string
+	version      string
+	port         uint16
+	nodeGroups   []string
+	domains      []string
+	rewrite      string
+	rewriteRegex string
+	priority     int
+	weight       *uint32
+	healthCheck  *types.HealthCheck
+	outlier      types.OutlierDetection
+	breakers     types.CircuitBreakers
+	lbPolicy     types.LbPolicy
+	hashPolicies []types.HashPolicy
+	// endpointWeight is 0 when not labelled
+	endpointWeight uint32
+	timeout        *time.Duration
+	idleTimeout    *time.Duration
+	retryPolicy    types.RetryPolicy
 }
 
 type discoverableContainer struct {
 	services  []service
 	container dTypes.Container
 	ports     []dTypes.Port
+	health    types.HealthStatus
+	draining  bool
+	cpus      float64
 }
 
 func toMap(texts []string) map[string]int {
@@ -71,6 +161,71 @@ func toMap(texts []string) map[string]int {
 	return m
 }
 
+// getNetworkPreferences lists network names in order of preference, the container label comes first, then the -network flag and lastly the default bridge
+func getNetworkPreferences(labels map[string]string) []string {
+	var names []string
+	for _, name := range []string{labels[networkLabelKey], preferredNetworkName, defaultNetworkName} {
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// getNetworkAddress picks the address from the most preferred network, falling back to the first network, by name, that has an address
+func getNetworkAddress(labels map[string]string, networks map[string]*network.EndpointSettings) (address string, networkName string) {
+	for _, name := range getNetworkPreferences(labels) {
+		if settings, exists := networks[name]; exists && settings != nil && len(settings.IPAddress) > 0 {
+			return settings.IPAddress, name
+		}
+	}
+	var names []string
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if settings := networks[name]; settings != nil && len(settings.IPAddress) > 0 {
+			return settings.IPAddress, name
+		}
+	}
+	return "", ""
+}
+
+func parseHealthMode(value string) (HealthMode, error) {
+	switch mode := HealthMode(strings.ToLower(value)); mode {
+	case HealthReport, HealthOmit, HealthIgnore:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown health mode %q, expecting %q, %q or %q", value, HealthReport, HealthOmit, HealthIgnore)
+}
+
+func parseAddressingMode(value string) (AddressingMode, error) {
+	switch mode := AddressingMode(strings.ToLower(value)); mode {
+	case AddressingContainer, AddressingPublished:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown addressing mode %q, expecting %q or %q", value, AddressingContainer, AddressingPublished)
+}
+
+// getAddressingMode reads the addressing mode from the container label, falling back to the -addressing flag
+func getAddressingMode(labels map[string]string) AddressingMode {
+	log := logger.New("getAddressingMode")
+	defer log.LogDone()
+	if value, exists := labels[addressingLabelKey]; exists {
+		mode, err := parseAddressingMode(value)
+		if err == nil {
+			return mode
+		}
+		log.Warnf("ignoring %s label, %s", addressingLabelKey, err.Error())
+	}
+	return AddressingMode(addressingMode)
+}
+
+func isUnspecifiedIP(ip string) bool {
+	return len(ip) < 1 || ip == "0.0.0.0" || ip == "::"
+}
+
 func mustAtoi(s string) int {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -79,10 +234,10 @@ func mustAtoi(s string) int {
 	return n
 }
 
-func getServicePorts(container dTypes.Container) []uint16 {
+func getServicePorts(labels map[string]string) []uint16 {
 	ports := []uint16{}
 	uniquePortsContainer := make(map[uint16]string)
-	for key := range container.Labels {
+	for key := range labels {
 		if serviceNamePattern.MatchString(key) {
 			submatches := serviceNamePattern.FindStringSubmatch(key)
 			port := uint16(mustAtoi(submatches[portIndex]))
@@ -95,38 +250,332 @@ func getServicePorts(container dTypes.Container) []uint16 {
 	return ports
 }
 
-func mapContainerToDiscoverableContainer(container dTypes.Container, servicePorts []uint16) *discoverableContainer {
-	log := logger.New("mapContainerToDiscoverableContainer")
+// labelKey resolves a label expression for a port, e.g. CLUSTER_80_NAME
+func labelKey(expr string, port uint16) string {
+	return strings.Replace(expr, portGroupExpr, strconv.Itoa(int(port)), 1)
+}
+
+// splitList splits a comma separated label value, blanks are left out
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getIntLabel reads a numeric label, the default is used when the label is missing or not a number
+func getIntLabel(labels map[string]string, key string, defaultValue int) int {
+	log := logger.New("getIntLabel")
+	defer log.LogDone()
+	value, exists := labels[key]
+	if !exists {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Warnf("ignoring %s label, %q is not a number", key, value)
+		return defaultValue
+	}
+	return number
+}
+
+// getUintLabel reads a label that cannot be negative, e.g. a weight, nil is returned when the label is missing or not a positive number
+func getUintLabel(labels map[string]string, key string) *uint32 {
+	log := logger.New("getUintLabel")
+	defer log.LogDone()
+	value, exists := labels[key]
+	if !exists {
+		return nil
+	}
+	number, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		log.Warnf("ignoring %s label, %q is not a positive number", key, value)
+		return nil
+	}
+	weight := uint32(number)
+	return &weight
+}
+
+// getCountLabel reads a label counting something, zero is returned when the label is missing or not a positive number
+func getCountLabel(labels map[string]string, key string) uint32 {
+	if count := getUintLabel(labels, key); count != nil {
+		return *count
+	}
+	return 0
+}
+
+// getEndpointWeightLabel reads an endpoint weight label, weights above the maximum are capped
+func getEndpointWeightLabel(labels map[string]string, key string) uint32 {
+	log := logger.New("getEndpointWeightLabel")
+	defer log.LogDone()
+	weight := getCountLabel(labels, key)
+	if weight > types.MaxEndpointWeight {
+		log.Warnf("capping %s label of %v to %v", key, weight, types.MaxEndpointWeight)
+		return types.MaxEndpointWeight
+	}
+	return weight
+}
+
+// getDurationLabel reads a duration label, e.g. 5s, zero is returned when the label is missing or not a duration
+func getDurationLabel(labels map[string]string, key string) time.Duration {
+	log := logger.New("getDurationLabel")
+	defer log.LogDone()
+	value, exists := labels[key]
+	if !exists {
+		return 0
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || duration < 0 {
+		log.Warnf("ignoring %s label, %q is not a duration", key, value)
+		return 0
+	}
+	return duration
+}
+
+// getTimeoutLabel reads a timeout label, 0 turns the timeout off, nil is returned when the label is missing or not a duration
+func getTimeoutLabel(labels map[string]string, key string) *time.Duration {
+	log := logger.New("getTimeoutLabel")
+	defer log.LogDone()
+	value, exists := labels[key]
+	if !exists {
+		return nil
+	}
+	timeout, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || timeout < 0 {
+		log.Warnf("ignoring %s label, %q is not a duration", key, value)
+		return nil
+	}
+	return &timeout
+}
+
+// getRetryPolicy reads the CLUSTER_<port>_RETRY_ON, NUM_RETRIES and PER_TRY_TIMEOUT labels,
+// failed requests are retried on 5xx responses when only the number of retries is labelled
+func getRetryPolicy(labels map[string]string, keyPrefix string) types.RetryPolicy {
+	retryPolicy := types.RetryPolicy{
+		RetryOn:       strings.Join(splitList(labels[keyPrefix+"_RETRY_ON"]), ","),
+		NumRetries:    getCountLabel(labels, keyPrefix+"_NUM_RETRIES"),
+		PerTryTimeout: getDurationLabel(labels, keyPrefix+"_PER_TRY_TIMEOUT"),
+	}
+	if len(retryPolicy.RetryOn) < 1 && retryPolicy.NumRetries > 0 {
+		retryPolicy.RetryOn = defaultRetryOn
+	}
+	return retryPolicy
+}
+
+// getHealthCheck reads the CLUSTER_<port>_HEALTHCHECK_* labels, there is no health check unless the path or protocol is labelled
+func getHealthCheck(labels map[string]string, keyPrefix string) *types.HealthCheck {
+	log := logger.New("getHealthCheck")
+	defer log.LogDone()
+	path, hasPath := labels[keyPrefix+"_PATH"]
+	protocolValue, hasProtocol := labels[keyPrefix+"_PROTOCOL"]
+	if !hasPath && !hasProtocol {
+		return nil
+	}
+	protocol := types.HealthCheckHTTP
+	if hasProtocol {
+		var err error
+		if protocol, err = types.ParseHealthCheckProtocol(protocolValue); err != nil {
+			log.Warnf("ignoring health check labels, %s", err.Error())
+			return nil
+		}
+	}
+	return &types.HealthCheck{
+		Protocol:           protocol,
+		Path:               strings.TrimSpace(path),
+		Interval:           getDurationLabel(labels, keyPrefix+"_INTERVAL"),
+		Timeout:            getDurationLabel(labels, keyPrefix+"_TIMEOUT"),
+		HealthyThreshold:   getCountLabel(labels, keyPrefix+"_HEALTHY_THRESHOLD"),
+		UnhealthyThreshold: getCountLabel(labels, keyPrefix+"_UNHEALTHY_THRESHOLD"),
+	}
+}
+
+// getOutlierDetection reads the CLUSTER_<port>_OUTLIER_* labels
+func getOutlierDetection(labels map[string]string, keyPrefix string) types.OutlierDetection {
+	return types.OutlierDetection{
+		Consecutive5xx:     getUintLabel(labels, keyPrefix+"_CONSECUTIVE_5XX"),
+		Interval:           getDurationLabel(labels, keyPrefix+"_INTERVAL"),
+		BaseEjectionTime:   getDurationLabel(labels, keyPrefix+"_BASE_EJECTION_TIME"),
+		MaxEjectionPercent: getCountLabel(labels, keyPrefix+"_MAX_EJECTION_PERCENT"),
+	}
+}
+
+// getCircuitBreakers reads the CLUSTER_<port>_MAX_* labels
+func getCircuitBreakers(labels map[string]string, keyPrefix string) types.CircuitBreakers {
+	return types.CircuitBreakers{
+		MaxConnections:     getCountLabel(labels, keyPrefix+"_MAX_CONNECTIONS"),
+		MaxPendingRequests: getCountLabel(labels, keyPrefix+"_MAX_PENDING_REQUESTS"),
+		MaxRequests:        getCountLabel(labels, keyPrefix+"_MAX_REQUESTS"),
+		MaxRetries:         getCountLabel(labels, keyPrefix+"_MAX_RETRIES"),
+	}
+}
+
+// getLbPolicy reads a load balancing policy label, round robin is used when the label is missing or unknown
+func getLbPolicy(labels map[string]string, key string) types.LbPolicy {
+	log := logger.New("getLbPolicy")
+	defer log.LogDone()
+	value, exists := labels[key]
+	if !exists {
+		return types.LbRoundRobin
+	}
+	policy, err := types.ParseLbPolicy(value)
+	if err != nil {
+		log.Warnf("ignoring %s label, %s", key, err.Error())
+		return types.LbRoundRobin
+	}
+	return policy
+}
+
+// getHashPolicies reads a comma separated hash policy label, e.g. cookie:session:1h,source_ip
+func getHashPolicies(labels map[string]string, key string) []types.HashPolicy {
+	log := logger.New("getHashPolicies")
+	defer log.LogDone()
+	var hashPolicies []types.HashPolicy
+	for _, value := range splitList(labels[key]) {
+		hashPolicy, err := types.ParseHashPolicy(value)
+		if err != nil {
+			log.Warnf("ignoring part of %s label, %s", key, err.Error())
+			continue
+		}
+		hashPolicies = append(hashPolicies, hashPolicy)
+	}
+	return hashPolicies
+}
+
+// getRegexLabel reads a regular expression label, nothing is returned when the label is missing or does not compile
+func getRegexLabel(labels map[string]string, key string) string {
+	log := logger.New("getRegexLabel")
 	defer log.LogDone()
-	labels := container.Labels
-	discoveredContainer := &discoverableContainer{
-		container: container,
+	value, exists := labels[key]
+	if !exists {
+		return ""
+	}
+	if _, err := regexp.Compile(value); err != nil {
+		log.Warnf("ignoring %s label, %s", key, err.Error())
+		return ""
+	}
+	return value
+}
+
+// getCPUWeight gives 10 per CPU so that fractions of a CPU still count, containers without a CPU limit count as one CPU
+func getCPUWeight(cpus float64) uint32 {
+	if cpus <= 0 {
+		return cpuWeightPerCPU
+	}
+	weight := math.Round(cpus * cpuWeightPerCPU)
+	if weight < 1 {
+		return 1
+	}
+	return uint32(math.Min(weight, types.MaxEndpointWeight))
+}
+
+// getEndpointWeight prefers the endpoint weight label over the CPU limit, 0 leaves the weight to envoy
+func (service service) getEndpointWeight(cpus float64) uint32 {
+	if service.endpointWeight > 0 || !cpuWeight {
+		return service.endpointWeight
 	}
+	return getCPUWeight(cpus)
+}
+
+func mapLabelsToServices(labels map[string]string, servicePorts []uint16) []service {
+	log := logger.New("mapLabelsToServices")
+	defer log.LogDone()
 	var services []service
 	for _, port := range servicePorts {
-		serviceNameLabelKey := strings.Replace(serviceNameExpr, portGroupExpr, strconv.Itoa(int(port)), 1)
-		urlPrefixLabelKey := strings.Replace(urlPrefixExpr, portGroupExpr, strconv.Itoa(int(port)), 1)
+		serviceNameLabelKey := labelKey(serviceNameExpr, port)
+		urlPrefixLabelKey := labelKey(urlPrefixExpr, port)
 		log.Infof("url prefix key %q\n", urlPrefixLabelKey)
 		service := service{
-			name:      labels[serviceNameLabelKey],
-			urlPrefix: labels[urlPrefixLabelKey],
-			version:   fmt.Sprintf("v%s-%s", labels[versionKey], labels[commitIDKey]),
-			port:      port,
+			name:           labels[serviceNameLabelKey],
+			urlPrefix:      labels[urlPrefixLabelKey],
+			version:        fmt.Sprintf("v%s-%s", labels[versionKey], labels[commitIDKey]),
+			port:           port,
+			nodeGroups:     splitList(labels[labelKey(nodeGroupsExpr, port)]),
+			domains:        splitList(labels[labelKey(domainsExpr, port)]),
+			rewrite:        labels[labelKey(rewriteExpr, port)],
+			rewriteRegex:   getRegexLabel(labels, labelKey(rewriteRegexExpr, port)),
+			priority:       getIntLabel(labels, labelKey(priorityExpr, port), 0),
+			weight:         getUintLabel(labels, labelKey(weightExpr, port)),
+			healthCheck:    getHealthCheck(labels, labelKey(healthCheckExpr, port)),
+			outlier:        getOutlierDetection(labels, labelKey(outlierExpr, port)),
+			breakers:       getCircuitBreakers(labels, labelKey(clusterExpr, port)),
+			lbPolicy:       getLbPolicy(labels, labelKey(lbPolicyExpr, port)),
+			hashPolicies:   getHashPolicies(labels, labelKey(hashPolicyExpr, port)),
+			endpointWeight: getEndpointWeightLabel(labels, labelKey(endpointWeightExpr, port)),
+			timeout:        getTimeoutLabel(labels, labelKey(timeoutExpr, port)),
+			idleTimeout:    getTimeoutLabel(labels, labelKey(idleTimeoutExpr, port)),
+			retryPolicy:    getRetryPolicy(labels, labelKey(clusterExpr, port)),
+		}
+		if _, labelled := labels[labelKey(rewriteRegexExpr, port)]; labelled && len(service.rewriteRegex) < 1 {
+			// the rewrite is the regex substitution, it would otherwise be taken for a prefix rewrite
+			service.rewrite = ""
 		}
 		log.Infof("discovered service url prefix - %s\n", service.urlPrefix)
 		services = append(services, service)
 	}
-	discoveredContainer.services = services
-	return discoveredContainer
+	return services
+}
+
+func (service service) frontProxyPath() string {
+	if len(service.urlPrefix) > 0 {
+		return service.urlPrefix
+	}
+	return fmt.Sprintf("/%s", service.name)
+}
+
+// mapToEndpoint gives the endpoint of a container or swarm task serving the service, cpus is its CPU limit or 0
+func (service service) mapToEndpoint(uniqueID string, host string, port uint16, created time.Time, cpus float64) types.Endpoint {
+	return types.Endpoint{
+		UniqueID:         uniqueID,
+		ClusterName:      service.name,
+		Host:             host,
+		Port:             uint32(port),
+		FrontProxyPath:   service.frontProxyPath(),
+		Version:          service.version,
+		NodeGroups:       service.nodeGroups,
+		Domains:          service.domains,
+		Rewrite:          service.rewrite,
+		RewriteRegex:     service.rewriteRegex,
+		RoutePriority:    service.priority,
+		VersionWeight:    service.weight,
+		HealthCheck:      service.healthCheck,
+		OutlierDetection: service.outlier,
+		CircuitBreakers:  service.breakers,
+		LbPolicy:         service.lbPolicy,
+		HashPolicies:     service.hashPolicies,
+		EndpointWeight:   service.getEndpointWeight(cpus),
+		Timeout:          service.timeout,
+		IdleTimeout:      service.idleTimeout,
+		RetryPolicy:      service.retryPolicy,
+		Created:          created,
+	}
+}
+
+func mapContainerToDiscoverableContainer(indexed indexedContainer, servicePorts []uint16) *discoverableContainer {
+	return &discoverableContainer{
+		container: indexed.container,
+		services:  mapLabelsToServices(indexed.container.Labels, servicePorts),
+		health:    indexed.health,
+		draining:  indexed.draining,
+		cpus:      indexed.cpus,
+	}
 }
 
-func getDiscoverableContainers(containers []dTypes.Container) []discoverableContainer {
+func getDiscoverableContainers(containers []indexedContainer) []discoverableContainer {
+	log := logger.New("getDiscoverableContainers")
+	defer log.LogDone()
 	var discoveredContainers []discoverableContainer
-	for _, container := range containers {
-		servicePorts := getServicePorts(container)
+	for _, indexed := range containers {
+		if HealthMode(healthMode) == HealthOmit && indexed.health == types.HealthUnhealthy && !indexed.draining {
+			log.Infof("omit container %s %v until it is healthy", indexed.container.ID, indexed.container.Names)
+			continue
+		}
+		servicePorts := getServicePorts(indexed.container.Labels)
 		if len(servicePorts) > 0 {
 			discoveredContainers = append(discoveredContainers,
-				*mapContainerToDiscoverableContainer(container, servicePorts))
+				*mapContainerToDiscoverableContainer(indexed, servicePorts))
 		}
 	}
 	return discoveredContainers
@@ -142,36 +591,83 @@ func (ports enPorts) wherePorts(predicate func(dTypes.Port) bool) []dTypes.Port
 	return matchingPorts
 }
 
-func (ports enPorts) getMappedAddress(portNumber uint16) (mappedPortNumber uint16) {
+// getMappedAddress resolves the host address and port a container port is published on, the port is 0 when it is not published
+func (ports enPorts) getMappedAddress(portNumber uint16) (mappedHost string, mappedPortNumber uint16) {
 	mappedPorts := ports.
 		wherePorts(func(p dTypes.Port) bool {
-			return p.PrivatePort == portNumber
+			return p.PrivatePort == portNumber && p.PublicPort > 0 && (len(p.Type) < 1 || p.Type == "tcp")
 		})
+	for _, mappedPort := range mappedPorts {
+		if !isUnspecifiedIP(mappedPort.IP) {
+			return mappedPort.IP, mappedPort.PublicPort
+		}
+	}
 	if len(mappedPorts) > 0 {
-		mappedPortNumber = mappedPorts[0].PrivatePort
+		mappedHost, mappedPortNumber = hostAddress, mappedPorts[0].PublicPort
 	}
 	return
 }
 
+func (container *discoverableContainer) isHostNetworked() bool {
+	return container.container.HostConfig.NetworkMode == hostNetworkMode
+}
+
+// getContainerAddress picks the container's IP address from its networks
+func (container *discoverableContainer) getContainerAddress() string {
+	log := logger.New("getContainerAddress")
+	defer log.LogDone()
+	dockerContainer := container.container
+	var networks map[string]*network.EndpointSettings
+	if dockerContainer.NetworkSettings != nil {
+		networks = dockerContainer.NetworkSettings.Networks
+	}
+	host, networkName := getNetworkAddress(dockerContainer.Labels, networks)
+	if len(host) < 1 {
+		log.Warnf("container %s %v has no IP address, preferred networks are %v",
+			dockerContainer.ID, dockerContainer.Names, getNetworkPreferences(dockerContainer.Labels))
+		return ""
+	}
+	if preferred := getNetworkPreferences(dockerContainer.Labels)[0]; preferred != networkName {
+		log.Warnf("container %s %v is not on network %q, using %q", dockerContainer.ID, dockerContainer.Names, preferred, networkName)
+	}
+	return host
+}
+
 func (container *discoverableContainer) mapToEndpoints() []types.Endpoint {
+	log := logger.New("mapToEndpoints")
+	defer log.LogDone()
 	var endpoints []types.Endpoint
 	dockerContainer := container.container
+	mode := getAddressingMode(dockerContainer.Labels)
+	var containerHost string
+	if container.isHostNetworked() {
+		log.Debugf("container %s %v uses the host network", dockerContainer.ID, dockerContainer.Names)
+		mode, containerHost = AddressingContainer, hostAddress
+	} else if mode == AddressingContainer {
+		if containerHost = container.getContainerAddress(); len(containerHost) < 1 {
+			log.Warnf("skip container %s %v", dockerContainer.ID, dockerContainer.Names)
+			return nil
+		}
+	}
 	for _, service := range container.services {
-		portNumber := enPorts(dockerContainer.Ports).
-			getMappedAddress(service.port)
-		host := dockerContainer.NetworkSettings.Networks["bridge"].IPAddress
-		frontProxyPath := fmt.Sprintf("/%s", service.name)
-		if len(service.urlPrefix) > 0 {
-			frontProxyPath = service.urlPrefix
+		host, portNumber := containerHost, service.port
+		if mode == AddressingPublished {
+			host, portNumber = enPorts(dockerContainer.Ports).
+				getMappedAddress(service.port)
+			if portNumber == 0 {
+				log.Warnf("skip service %q of container %s %v, port %v is not published",
+					service.name, dockerContainer.ID, dockerContainer.Names, service.port)
+				continue
+			}
 		}
 
-		endpoint := types.Endpoint{
-			UniqueID:       dockerContainer.ID,
-			ClusterName:    service.name,
-			Host:           host,
-			Port:           uint32(portNumber),
-			FrontProxyPath: frontProxyPath,
-			Version:        service.version,
+		endpoint := service.mapToEndpoint(dockerContainer.ID, host, portNumber,
+			time.Unix(dockerContainer.Created, 0).UTC(), container.cpus)
+		if HealthMode(healthMode) != HealthIgnore {
+			endpoint.Health = container.health
+		}
+		if container.draining {
+			endpoint.Health = types.HealthDraining
 		}
 		endpoints = append(endpoints, endpoint)
 	}
@@ -179,27 +675,8 @@ func (container *discoverableContainer) mapToEndpoints() []types.Endpoint {
 	return endpoints
 }
 
-func (session *Session) waitForCompletion(evt events.Message) {
-	//todo: properly wait
-	<-time.After(5 * time.Second)
-}
-
 func (session *Session) getEndpointUpdateRequest() *types.EndpointUpdateRequest {
-	appContext := ctx.GetContext()
-	log := logger.New("getEndpointUpdateRequest")
-	defer log.LogDone()
-	api := session.api
-	containerFilters := filters.NewArgs()
-	containerFilters.Add("status", "running")
-	containers, err := api.ContainerList(appContext, dTypes.ContainerListOptions{
-		Filters: containerFilters,
-	})
-	if err != nil {
-		log.Warnf("error listing container, %s", err.Error())
-		return nil
-	}
-
-	discoveredContainers := getDiscoverableContainers(containers)
+	discoveredContainers := getDiscoverableContainers(session.containers.containers())
 
 	var endpoints []types.Endpoint
 	for _, discoveredContainer := range discoveredContainers {
@@ -215,68 +692,263 @@ func (session *Session) getEndpointUpdateRequest() *types.EndpointUpdateRequest
 	return updateRequest
 }
 
-func New() *Session {
+// getEventContainerID is the container an event is about, network events carry it as an attribute
+func getEventContainerID(evt events.Message) string {
+	if evt.Type == events.NetworkEventType {
+		return evt.Actor.Attributes["container"]
+	}
+	if len(evt.Actor.ID) > 0 {
+		return evt.Actor.ID
+	}
+	return evt.ID
+}
+
+// getEventAction strips the details from actions such as "health_status: healthy"
+func getEventAction(evt events.Message) ContainerEvent {
+	return ContainerEvent(strings.TrimSpace(strings.SplitN(evt.Action, ":", 2)[0]))
+}
+
+// reconcile applies a single container event to the index
+func (session *Session) reconcile(evt events.Message) error {
+	log := logger.New("reconcile")
+	defer log.LogDone()
+	containerID := getEventContainerID(evt)
+	indexed, indexedAlready := session.containers[containerID]
+	action := getEventAction(evt)
+	switch action {
+	case EventKill, EventStop:
+		if !indexedAlready || indexed.draining || drainPeriod <= 0 {
+			return nil
+		}
+		if signal := evt.Actor.Attributes["signal"]; action == EventKill && !indexed.isStopping(signal) {
+			log.Infof("container %s %v received signal %s, not draining", containerID, indexed.container.Names, signal)
+			return nil
+		}
+		log.Infof("draining container %s %v for %v", containerID, indexed.container.Names, drainPeriod)
+		indexed.draining = true
+		session.containers[containerID] = indexed
+		session.scheduleDrainCompletion(containerID)
+		return nil
+	case EventDie:
+		if indexedAlready {
+			session.markDied(containerID, indexed)
+		}
+		return nil
+	}
+	container, err := inspect(session.ctx, session.api, containerID)
+	if err != nil {
+		return err
+	}
+	if container == nil {
+		if indexedAlready {
+			session.markDied(containerID, indexed)
+		}
+		return nil
+	}
+	if indexed.draining && action != EventStart {
+		container.draining = true
+		container.drained = indexed.drained
+	}
+	session.containers[containerID] = *container
+	return nil
+}
+
+// markDied removes a container that is gone, draining containers stay until their drain period is over
+func (session *Session) markDied(containerID string, indexed indexedContainer) {
+	if !indexed.draining || indexed.drained {
+		delete(session.containers, containerID)
+		return
+	}
+	indexed.died = true
+	session.containers[containerID] = indexed
+}
+
+// scheduleDrainCompletion signals the end of a container's drain period
+func (session *Session) scheduleDrainCompletion(containerID string) {
+	time.AfterFunc(drainPeriod, func() {
+		select {
+		case session.drainedChannel <- containerID:
+		case <-session.ctx.Done():
+		}
+	})
+}
+
+// completeDrain ends a container's drain period, containers that are still shutting down, e.g. with a longer stop timeout,
+// keep draining until they die
+func (session *Session) completeDrain(containerID string) {
+	log := logger.New("completeDrain")
+	defer log.LogDone()
+	indexed, exists := session.containers[containerID]
+	if !exists || !indexed.draining {
+		return
+	}
+	if indexed.died {
+		log.Infof("removing drained container %s %v", containerID, indexed.container.Names)
+		delete(session.containers, containerID)
+		return
+	}
+	log.Infof("container %s %v is still running after its drain period, draining it until it dies", containerID, indexed.container.Names)
+	indexed.drained = true
+	session.containers[containerID] = indexed
+}
+
+// publish sends the endpoints of the indexed containers, it returns false when the session has ended
+func (session *Session) publish() bool {
+	select {
+	case session.updateRequestChannel <- session.getEndpointUpdateRequest():
+		return true
+	case <-session.ctx.Done():
+		return false
+	}
+}
+
+// watchEvents reconciles the index with every event until the event stream fails or the session ends,
+// handled tells whether any event was applied before that
+func (session *Session) watchEvents(eventsChannel <-chan events.Message, errChannel <-chan error) (handled bool, err error) {
+	log := logger.New("watchEvents")
+	defer log.LogDone()
+	for {
+		log.Debug("waiting for a whale event...")
+		select {
+		case evt := <-eventsChannel:
+			log.Infof("received %q event from %v", evt.Action, evt.From)
+			if err := session.reconcile(evt); err != nil {
+				return handled, err
+			}
+			handled = true
+			if !session.publish() {
+				return handled, nil
+			}
+		case containerID := <-session.drainedChannel:
+			session.completeDrain(containerID)
+			handled = true
+			if !session.publish() {
+				return handled, nil
+			}
+		case err := <-errChannel:
+			if err == nil {
+				return handled, errors.New("event stream closed")
+			}
+			return handled, err
+		case <-session.ctx.Done():
+			log.Infof("exiting after receiving request to end event loop")
+			return handled, nil
+		}
+	}
+}
+
+func init() {
+	flag.StringVar(&preferredNetworkName, "network", "",
+		fmt.Sprintf("container network used for endpoint addresses, overridden by the %s label, defaults to %q", networkLabelKey, defaultNetworkName))
+	flag.StringVar(&addressingMode, "addressing", string(AddressingContainer),
+		fmt.Sprintf("%q uses container IPs and ports, %q uses the host address and published ports, overridden by the %s label",
+			AddressingContainer, AddressingPublished, addressingLabelKey))
+	flag.StringVar(&hostAddress, "hostAddress", "127.0.0.1", "address of the docker host, used for host networked containers and published ports bound to all interfaces")
+	flag.StringVar(&healthMode, "health", string(HealthReport),
+		fmt.Sprintf("%q marks starting and unhealthy containers as unhealthy in envoy, %q leaves them out, %q disregards docker health checks",
+			HealthReport, HealthOmit, HealthIgnore))
+	flag.DurationVar(&drainPeriod, "drainPeriod", 10*time.Second,
+		"how long a stopping container is kept as draining before it is removed, 0 removes it as soon as it dies")
+	flag.BoolVar(&cpuWeight, "cpuWeight", false,
+		"weigh endpoints by their container's CPU limit, 10 per CPU, unless they have an endpoint weight label")
+	registry.Register(types.PluginDocker, func() (registry.Source, error) {
+		mode, err := parseAddressingMode(addressingMode)
+		if err != nil {
+			return nil, err
+		}
+		addressingMode = string(mode)
+		health, err := parseHealthMode(healthMode)
+		if err != nil {
+			return nil, err
+		}
+		healthMode = string(health)
+		return New()
+	})
+}
+
+func New() (*Session, error) {
 	log := logger.New("connectToDocker")
 	defer log.LogDone()
 	dockerApi, err := dClient.NewEnvClient()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	sessionCtx, cancel := context.WithCancel(ctx.GetContext())
 	return &Session{
-		api: dockerApi,
-	}
+		api:                  dockerApi,
+		ctx:                  sessionCtx,
+		cancel:               cancel,
+		updateRequestChannel: make(chan *types.EndpointUpdateRequest),
+		drainedChannel:       make(chan string),
+	}, nil
+}
+
+func (session *Session) Name() types.PluginType {
+	return types.PluginDocker
+}
+
+func (session *Session) Updates() <-chan *types.EndpointUpdateRequest {
+	return session.updateRequestChannel
+}
+
+func (session *Session) Stop() {
+	session.cancel()
 }
 
-func (session *Session) Run() chan *types.EndpointUpdateRequest {
+func (session *Session) Start() error {
 	log := logger.New("runDockerRegistry")
 	defer log.LogDone()
-	appContext := ctx.GetContext()
+	appContext := session.ctx
 	api := session.api
 
 	eventFilters := filters.NewArgs()
-	eventFilters.Add("event", string(EventStart))
-	eventFilters.Add("event", string(EventDie))
+	eventFilters.Add("type", events.ContainerEventType)
+	eventFilters.Add("type", events.NetworkEventType)
+	for _, event := range []ContainerEvent{EventStart, EventDie, EventHealthStatus, EventRename, EventKill, EventStop, EventConnect, EventDisconnect} {
+		eventFilters.Add("event", string(event))
+	}
 	eventsOptions := dTypes.EventsOptions{
 		Filters: eventFilters,
 	}
-	log.Info("connecting to events channel...")
-	eventsChannel, errChannel := api.Events(appContext, eventsOptions)
-	log.Info("connected to events channel")
-	updateRequestChannel := make(chan *types.EndpointUpdateRequest)
+	updateRequestChannel := session.updateRequestChannel
 	go func(session *Session) {
 		defer close(updateRequestChannel)
 		errCnt := 0
 		for {
-			log.Info("get update request update request")
-			updateRequest := session.getEndpointUpdateRequest()
-			if updateRequest == nil {
-				errCnt = errCnt + 1
-				continue
+			// subscribe before seeding so that no event between the listing and the subscription is missed
+			log.Info("connecting to events channel...")
+			eventsContext, cancelEvents := context.WithCancel(appContext)
+			eventsChannel, errChannel := api.Events(eventsContext, eventsOptions)
+			containers, err := seedIndex(appContext, api)
+			if err == nil {
+				session.containers = containers
+				if !session.publish() {
+					cancelEvents()
+					log.Info("terminating scanner loop")
+					return
+				}
+				var handled bool
+				handled, err = session.watchEvents(eventsChannel, errChannel)
+				// only a working event stream clears the errors, seeding alone succeeds even when the stream keeps failing
+				if handled {
+					errCnt = 0
+				}
 			}
-			select {
-			case updateRequestChannel <- updateRequest:
-				log.Info("sending update request")
-			case <-appContext.Done():
-				log.Info("terminating scanner loop")
+			cancelEvents()
+			if appContext.Err() != nil {
 				return
 			}
-
-			log.Debug("waiting for a whale event...")
+			errCnt = errCnt + 1
+			if errCnt > 10 {
+				log.Fail("too many errors detected")
+			}
+			log.Warnf("resynchronising after error, %s", err.Error())
 			select {
-			case evt := <-eventsChannel:
-				log.Infof("received %q event from %v", evt.Action, evt.From)
-				session.waitForCompletion(evt)
-			case err := <-errChannel:
-				log.Infof("error detected from event system, %s", err.Error())
-				errCnt = errCnt + 1
+			case <-time.After(time.Duration(errCnt) * time.Second):
 			case <-appContext.Done():
-				log.Infof("exiting after receiving request to end event loop")
 				return
 			}
-			if errCnt > 10 {
-				log.Fail("too many errors detected")
-			}
 		}
 	}(session)
-	return updateRequestChannel
+	return nil
 }
@@ -0,0 +1,193 @@
+package whale
+
+import (
+	"context"
+	"testing"
+
+	dTypes "github.com/docker/docker/api/types"
+	dContainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+)
+
+func newKillEvent(containerID string, signal string) events.Message {
+	return events.Message{
+		Type:   "container",
+		Action: string(EventKill),
+		Actor: events.Actor{
+			ID:         containerID,
+			Attributes: map[string]string{"signal": signal},
+		},
+	}
+}
+
+func TestGetEventContainerID(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		evt  events.Message
+	}{
+		{"container event", events.Message{Type: events.ContainerEventType, Action: string(EventStart), Actor: events.Actor{ID: "c1"}}},
+		{"network event", events.Message{Type: events.NetworkEventType, Action: string(EventConnect),
+			Actor: events.Actor{ID: "n1", Attributes: map[string]string{"container": "c1", "name": "backend"}}}},
+	} {
+		if containerID := getEventContainerID(tc.evt); containerID != "c1" {
+			t.Errorf("%s is about container %q", tc.name, containerID)
+		}
+	}
+}
+
+func TestReconcileDrainsOnlyOnStopSignals(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		stopSignal int
+		signal     string
+		draining   bool
+	}{
+		{"SIGTERM", sigTerm, "15", true},
+		{"configured stop signal", 3, "3", true},
+		{"SIGTERM with another stop signal", 3, "15", true},
+		{"SIGHUP", sigTerm, "1", false},
+		{"SIGKILL", sigTerm, "9", false},
+		{"SIGKILL as the stop signal", sigKill, "9", false},
+		{"unknown signal", sigTerm, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sessionCtx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			session := &Session{
+				ctx:            sessionCtx,
+				cancel:         cancel,
+				drainedChannel: make(chan string),
+				containers: containerIndex{
+					"c1": {container: dTypes.Container{ID: "c1"}, stopSignal: tc.stopSignal},
+				},
+			}
+			if err := session.reconcile(newKillEvent("c1", tc.signal)); err != nil {
+				t.Fatal(err)
+			}
+			if draining := session.containers["c1"].draining; draining != tc.draining {
+				t.Errorf("draining is %v, expecting %v", draining, tc.draining)
+			}
+		})
+	}
+}
+
+func TestGetStopSignal(t *testing.T) {
+	for value, expected := range map[string]int{
+		"":         sigTerm,
+		"SIGQUIT":  3,
+		"QUIT":     3,
+		"sigint":   2,
+		"10":       10,
+		"SIGBOGUS": sigTerm,
+	} {
+		if stopSignal := getStopSignal(&dContainer.Config{StopSignal: value}); stopSignal != expected {
+			t.Errorf("%q parsed as %v, expecting %v", value, stopSignal, expected)
+		}
+	}
+	if stopSignal := getStopSignal(nil); stopSignal != sigTerm {
+		t.Errorf("stop signal without a config is %v", stopSignal)
+	}
+}
+
+func TestInvalidRewriteRegexIsDropped(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		regex        string
+		rewrite      string
+		rewriteRegex string
+	}{
+		{"valid", "^/api/(v[0-9]+)/", "/\\1/", "^/api/(v[0-9]+)/"},
+		{"invalid", "^/api/(v[0-9]+/", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			services := mapLabelsToServices(map[string]string{
+				"CLUSTER_80_NAME":          "api",
+				"CLUSTER_80_REWRITE":       "/\\1/",
+				"CLUSTER_80_REWRITE_REGEX": tc.regex,
+			}, []uint16{80})
+			if services[0].rewriteRegex != tc.rewriteRegex || services[0].rewrite != tc.rewrite {
+				t.Errorf("rewrite is %q with regex %q", services[0].rewrite, services[0].rewriteRegex)
+			}
+		})
+	}
+}
+
+func TestOutlierConsecutive5xxLabel(t *testing.T) {
+	if consecutive5xx := getOutlierDetection(map[string]string{}, "CLUSTER_80_OUTLIER").Consecutive5xx; consecutive5xx != nil {
+		t.Errorf("consecutive 5xx without a label is %v", *consecutive5xx)
+	}
+	labels := map[string]string{"CLUSTER_80_OUTLIER_CONSECUTIVE_5XX": "0"}
+	if consecutive5xx := getOutlierDetection(labels, "CLUSTER_80_OUTLIER").Consecutive5xx; consecutive5xx == nil || *consecutive5xx != 0 {
+		t.Errorf("consecutive 5xx labelled 0 is %v", consecutive5xx)
+	}
+}
+
+func newDrainingSession(t *testing.T) *Session {
+	t.Helper()
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	session := &Session{
+		ctx:            sessionCtx,
+		cancel:         cancel,
+		drainedChannel: make(chan string, 1),
+		containers: containerIndex{
+			"c1": {container: dTypes.Container{ID: "c1"}, stopSignal: sigTerm},
+		},
+	}
+	if err := session.reconcile(newKillEvent("c1", "15")); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func newDieEvent(containerID string) events.Message {
+	return events.Message{Type: events.ContainerEventType, Action: string(EventDie), Actor: events.Actor{ID: containerID}}
+}
+
+func TestDrainingContainerIsRemovedOnceDeadAndDrained(t *testing.T) {
+	t.Run("dies after the drain period", func(t *testing.T) {
+		session := newDrainingSession(t)
+		session.completeDrain("c1")
+		indexed, exists := session.containers["c1"]
+		if !exists || !indexed.draining {
+			t.Fatalf("container still shutting down after its drain period is not draining, %+v", indexed)
+		}
+		if err := session.reconcile(newDieEvent("c1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := session.containers["c1"]; exists {
+			t.Error("container is kept after it died")
+		}
+	})
+	t.Run("dies within the drain period", func(t *testing.T) {
+		session := newDrainingSession(t)
+		if err := session.reconcile(newDieEvent("c1")); err != nil {
+			t.Fatal(err)
+		}
+		if indexed, exists := session.containers["c1"]; !exists || !indexed.draining {
+			t.Fatalf("container is removed before its drain period is over, %+v", indexed)
+		}
+		session.completeDrain("c1")
+		if _, exists := session.containers["c1"]; exists {
+			t.Error("container is kept after its drain period")
+		}
+	})
+}
+
+func TestEndpointWeightIsCapped(t *testing.T) {
+	for value, expected := range map[string]uint32{
+		"4":          4,
+		"10000":      10000,
+		"10001":      10000,
+		"4294967295": 10000,
+		"-1":         0,
+	} {
+		labels := map[string]string{"CLUSTER_80_ENDPOINT_WEIGHT": value}
+		if weight := getEndpointWeightLabel(labels, "CLUSTER_80_ENDPOINT_WEIGHT"); weight != expected {
+			t.Errorf("weight labelled %s is %v, expecting %v", value, weight, expected)
+		}
+	}
+	if weight := getCPUWeight(1e6); weight != 10000 {
+		t.Errorf("weight of a million CPUs is %v", weight)
+	}
+}
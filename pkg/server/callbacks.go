@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+)
+
+// NodeClusterHash groups envoy nodes by their cluster, so every node of a cluster receives the same snapshot
+type NodeClusterHash struct{}
+
+// ID uses the node cluster field
+func (NodeClusterHash) ID(node *core.Node) string {
+	if node == nil {
+		return ""
+	}
+	return node.Cluster
+}
+
+var _ cachev3.NodeHash = NodeClusterHash{}
+
+// Callbacks keeps track of the connected envoy nodes, the snapshot key of a node is published on NewNodes when it connects
+// and on GoneNodes once the last stream with that key closes
+type Callbacks struct {
+	NewNodes  chan string
+	GoneNodes chan string
+	ctx       context.Context
+	hash      cachev3.NodeHash
+	mu        sync.Mutex
+	streams   map[int64]string
+	// connected counts the open streams of every snapshot key
+	connected map[string]int
+	// fetched keys are only seen in fetch requests, which have no stream to close, they are never gone
+	fetched map[string]bool
+}
+
+func NewCallbacks(ctx context.Context, hash cachev3.NodeHash) *Callbacks {
+	return &Callbacks{
+		NewNodes:  make(chan string),
+		GoneNodes: make(chan string),
+		ctx:       ctx,
+		hash:      hash,
+		streams:   make(map[int64]string),
+		connected: make(map[string]int),
+		fetched:   make(map[string]bool),
+	}
+}
+
+// IsConnected indicates whether any node with the snapshot key is connected
+func (cb *Callbacks) IsConnected(key string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.isConnected(key)
+}
+
+func (cb *Callbacks) isConnected(key string) bool {
+	return cb.connected[key] > 0 || cb.fetched[key]
+}
+
+func (cb *Callbacks) publish(nodes chan<- string, key string) {
+	select {
+	case nodes <- key:
+	case <-cb.ctx.Done():
+	}
+}
+
+// track counts the stream of a node, fetch requests are tracked without a stream
+func (cb *Callbacks) track(node *core.Node, streamID int64, streaming bool) string {
+	key := cb.hash.ID(node)
+	cb.mu.Lock()
+	if _, tracked := cb.streams[streamID]; streaming && tracked {
+		cb.mu.Unlock()
+		return key
+	}
+	isNew := !cb.isConnected(key)
+	if streaming {
+		cb.streams[streamID] = key
+		cb.connected[key]++
+	} else {
+		cb.fetched[key] = true
+	}
+	cb.mu.Unlock()
+	if isNew {
+		log := logger.New("trackNode")
+		defer log.LogDone()
+		log.Infof("node %q connected, snapshot key is %q", node.GetId(), key)
+		cb.publish(cb.NewNodes, key)
+	}
+	return key
+}
+
+func (cb *Callbacks) OnStreamOpen(_ context.Context, id int64, typ string) error {
+	return nil
+}
+
+// OnStreamClosed publishes the snapshot key of the stream once no other stream uses it
+func (cb *Callbacks) OnStreamClosed(id int64) {
+	cb.mu.Lock()
+	key, tracked := cb.streams[id]
+	delete(cb.streams, id)
+	var gone bool
+	if tracked {
+		cb.connected[key]--
+		if cb.connected[key] < 1 {
+			delete(cb.connected, key)
+			gone = !cb.isConnected(key)
+		}
+	}
+	cb.mu.Unlock()
+	if gone {
+		log := logger.New("untrackNode")
+		defer log.LogDone()
+		log.Infof("last stream of snapshot key %q closed", key)
+		cb.publish(cb.GoneNodes, key)
+	}
+}
+
+// OnStreamRequest tracks the node of a stream, envoy may only send the node on the first request of a stream
+func (cb *Callbacks) OnStreamRequest(id int64, request *discovery.DiscoveryRequest) error {
+	if request.GetNode() == nil {
+		return nil
+	}
+	cb.track(request.GetNode(), id, true)
+	return nil
+}
+
+func (cb *Callbacks) OnStreamResponse(int64, *discovery.DiscoveryRequest, *discovery.DiscoveryResponse) {
+}
+
+func (cb *Callbacks) OnFetchRequest(_ context.Context, request *discovery.DiscoveryRequest) error {
+	if request.GetNode() != nil {
+		cb.track(request.GetNode(), 0, false)
+	}
+	return nil
+}
+
+func (cb *Callbacks) OnFetchResponse(*discovery.DiscoveryRequest, *discovery.DiscoveryResponse) {}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/kahgeh/whale-disco/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Initialise(logger.NormalLogLevel)
+	os.Exit(m.Run())
+}
+
+func newRequest(id string, cluster string) *discovery.DiscoveryRequest {
+	return &discovery.DiscoveryRequest{Node: &core.Node{Id: id, Cluster: cluster}}
+}
+
+// published runs a callback and gives the snapshot key it published on nodes, if any
+func published(t *testing.T, nodes <-chan string, callback func()) string {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		callback()
+		close(done)
+	}()
+	key := ""
+	select {
+	case key = <-nodes:
+	case <-done:
+		return ""
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback blocked")
+	}
+	<-done
+	return key
+}
+
+func TestTrackCountsStreamsPerKey(t *testing.T) {
+	appContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cb := NewCallbacks(appContext, NodeClusterHash{})
+	streamRequest := func(streamID int64, id string) func() {
+		return func() { cb.OnStreamRequest(streamID, newRequest(id, "front")) }
+	}
+	streamClosed := func(streamID int64) func() {
+		return func() { cb.OnStreamClosed(streamID) }
+	}
+
+	if key := published(t, cb.NewNodes, streamRequest(1, "envoy-1")); key != "front" {
+		t.Fatalf("new key is %q", key)
+	}
+	// later requests of the stream and other nodes with the same key are not new
+	for _, callback := range []func(){streamRequest(1, "envoy-1"), streamRequest(2, "envoy-2")} {
+		if key := published(t, cb.NewNodes, callback); key != "" {
+			t.Errorf("%q published again", key)
+		}
+	}
+
+	if key := published(t, cb.GoneNodes, streamClosed(1)); key != "" {
+		t.Errorf("%q gone while a stream is open", key)
+	}
+	if !cb.IsConnected("front") {
+		t.Fatal("front is not connected while a stream is open")
+	}
+	if key := published(t, cb.GoneNodes, streamClosed(2)); key != "front" {
+		t.Errorf("gone key is %q", key)
+	}
+	if cb.IsConnected("front") {
+		t.Error("front is connected after its last stream closed")
+	}
+	if key := published(t, cb.GoneNodes, streamClosed(2)); key != "" {
+		t.Errorf("%q gone twice", key)
+	}
+
+	if key := published(t, cb.NewNodes, streamRequest(3, "envoy-3")); key != "front" {
+		t.Errorf("reconnected key is %q", key)
+	}
+}
+
+func TestTrackKeepsFetchedNodes(t *testing.T) {
+	appContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cb := NewCallbacks(appContext, cachev3.IDHash{})
+
+	key := published(t, cb.NewNodes, func() { cb.OnFetchRequest(appContext, newRequest("envoy-1", "front")) })
+	if key != "envoy-1" {
+		t.Fatalf("new key is %q", key)
+	}
+	if key := published(t, cb.NewNodes, func() { cb.OnStreamRequest(1, newRequest("envoy-1", "front")) }); key != "" {
+		t.Errorf("%q published again", key)
+	}
+	if key := published(t, cb.GoneNodes, func() { cb.OnStreamClosed(1) }); key != "" {
+		t.Errorf("%q polling with fetch requests is gone", key)
+	}
+	if !cb.IsConnected("envoy-1") {
+		t.Error("node polling with fetch requests is not connected")
+	}
+}
+
+func TestStreamsWithoutNodeAreNotTracked(t *testing.T) {
+	appContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cb := NewCallbacks(appContext, cachev3.IDHash{})
+	if key := published(t, cb.NewNodes, func() { cb.OnStreamRequest(1, &discovery.DiscoveryRequest{}) }); key != "" {
+		t.Errorf("%q published", key)
+	}
+	if key := published(t, cb.GoneNodes, func() { cb.OnStreamClosed(1) }); key != "" {
+		t.Errorf("%q gone", key)
+	}
+}
@@ -0,0 +1,76 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/validation"
+)
+
+// Report is the state of the last update received from the discovery sources
+type Report struct {
+	Version    int               `json:"version"`
+	UpdatedAt  time.Time         `json:"updatedAt"`
+	Clusters   []string          `json:"clusters"`
+	NodeGroups []string          `json:"nodeGroups"`
+	Validation validation.Result `json:"validation"`
+}
+
+// Board holds the latest report and serves it as JSON
+type Board struct {
+	mu     sync.RWMutex
+	report Report
+}
+
+func NewBoard() *Board {
+	return &Board{}
+}
+
+// Set replaces the latest report
+func (board *Board) Set(report Report) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	board.report = report
+}
+
+// Get returns the latest report
+func (board *Board) Get() Report {
+	board.mu.RLock()
+	defer board.mu.RUnlock()
+	return board.report
+}
+
+func (board *Board) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	report := board.Get()
+	writer.Header().Set("Content-Type", "application/json")
+	if report.Validation.Rejected {
+		writer.WriteHeader(http.StatusConflict)
+	}
+	if err := json.NewEncoder(writer).Encode(report); err != nil {
+		log := logger.New("serveStatus")
+		defer log.LogDone()
+		log.Warnf("failed to write status, %s", err.Error())
+	}
+}
+
+// RunServer serves the board on /status until the context is done
+func RunServer(appContext context.Context, board *Board, port uint) {
+	log := logger.New("runStatusServer")
+	defer log.LogDone()
+	mux := http.NewServeMux()
+	mux.Handle("/status", board)
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	go func() {
+		<-appContext.Done()
+		httpServer.Close()
+	}()
+	log.Infof("status server listening on %d", port)
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fail(err.Error())
+	}
+}
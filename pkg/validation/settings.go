@@ -0,0 +1,155 @@
+package validation
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// clusterSettings are the endpoint fields that configure the cluster or its routes rather than the endpoint itself,
+// every endpoint of a cluster has to agree on them
+type clusterSettings struct {
+	Domains          []string
+	RoutePriority    int
+	Rewrite          string
+	RewriteRegex     string
+	HealthCheck      *types.HealthCheck
+	OutlierDetection types.OutlierDetection
+	CircuitBreakers  types.CircuitBreakers
+	LbPolicy         types.LbPolicy
+	HashPolicies     []types.HashPolicy
+	Timeout          *time.Duration
+	IdleTimeout      *time.Duration
+	RetryPolicy      types.RetryPolicy
+}
+
+func getClusterSettings(endpoint types.Endpoint) clusterSettings {
+	settings := clusterSettings{
+		Domains:          endpoint.Domains,
+		RoutePriority:    endpoint.RoutePriority,
+		Rewrite:          endpoint.Rewrite,
+		RewriteRegex:     endpoint.RewriteRegex,
+		HealthCheck:      endpoint.HealthCheck,
+		OutlierDetection: endpoint.OutlierDetection,
+		CircuitBreakers:  endpoint.CircuitBreakers,
+		LbPolicy:         endpoint.LbPolicy,
+		HashPolicies:     endpoint.HashPolicies,
+		Timeout:          endpoint.Timeout,
+		IdleTimeout:      endpoint.IdleTimeout,
+		RetryPolicy:      endpoint.RetryPolicy,
+	}
+	// sources leave lists out or empty alike
+	if len(settings.Domains) < 1 {
+		settings.Domains = nil
+	}
+	if len(settings.HashPolicies) < 1 {
+		settings.HashPolicies = nil
+	}
+	return settings
+}
+
+// applyTo gives an endpoint the settings
+func (settings clusterSettings) applyTo(endpoint types.Endpoint) types.Endpoint {
+	endpoint.Domains = settings.Domains
+	endpoint.RoutePriority = settings.RoutePriority
+	endpoint.Rewrite = settings.Rewrite
+	endpoint.RewriteRegex = settings.RewriteRegex
+	endpoint.HealthCheck = settings.HealthCheck
+	endpoint.OutlierDetection = settings.OutlierDetection
+	endpoint.CircuitBreakers = settings.CircuitBreakers
+	endpoint.LbPolicy = settings.LbPolicy
+	endpoint.HashPolicies = settings.HashPolicies
+	endpoint.Timeout = settings.Timeout
+	endpoint.IdleTimeout = settings.IdleTimeout
+	endpoint.RetryPolicy = settings.RetryPolicy
+	return endpoint
+}
+
+// key identifies the settings by value, pointers included
+func (settings clusterSettings) key() string {
+	value, _ := json.Marshal(settings)
+	return string(value)
+}
+
+// differences names the settings that are not the same in every group
+func differences(groups map[string][]types.Endpoint) []string {
+	var names []string
+	var first reflect.Value
+	for _, key := range sortedKeys(groups) {
+		settings := reflect.ValueOf(getClusterSettings(groups[key][0]))
+		if !first.IsValid() {
+			first = settings
+			continue
+		}
+		for i := 0; i < settings.NumField(); i++ {
+			name := settings.Type().Field(i).Name
+			if reflect.DeepEqual(settings.Field(i).Interface(), first.Field(i).Interface()) || contains(names, name) {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func groupBySettings(endpoints []types.Endpoint) map[string][]types.Endpoint {
+	groups := make(map[string][]types.Endpoint)
+	for _, endpoint := range endpoints {
+		key := getClusterSettings(endpoint).key()
+		groups[key] = append(groups[key], endpoint)
+	}
+	return groups
+}
+
+// decidingEndpoint is the endpoint whose creation time decides for a group of endpoints
+func (policy Policy) decidingEndpoint(endpoints []types.Endpoint) types.Endpoint {
+	created := policy.representative(endpoints)
+	for _, endpoint := range endpoints {
+		if endpoint.Created.Equal(created) {
+			return endpoint
+		}
+	}
+	return endpoints[0]
+}
+
+// resolveClusterSettings makes every endpoint of a cluster share the cluster's settings, e.g. while a rolling update changes a label,
+// the settings of the endpoint picked by the policy are kept
+func resolveClusterSettings(clusterEndpoints map[string][]types.Endpoint, result *Result) map[string][]types.Endpoint {
+	resolved := make(map[string][]types.Endpoint)
+	for _, clusterName := range sortedKeys(clusterEndpoints) {
+		endpoints := clusterEndpoints[clusterName]
+		resolved[clusterName] = endpoints
+		groups := groupBySettings(endpoints)
+		if len(groups) < 2 {
+			continue
+		}
+		conflict := Conflict{
+			Kind:     ConflictClusterSettings,
+			Clusters: []string{clusterName},
+			Settings: differences(groups),
+		}
+		if result.Policy != PolicyReject {
+			kept := result.Policy.decidingEndpoint(groups[result.Policy.pick(sortedKeys(groups), groups)])
+			conflict.Kept = kept.UniqueID
+			settings := getClusterSettings(kept)
+			var agreeing []types.Endpoint
+			for _, endpoint := range endpoints {
+				agreeing = append(agreeing, settings.applyTo(endpoint))
+			}
+			resolved[clusterName] = agreeing
+		}
+		result.Conflicts = append(result.Conflicts, conflict)
+	}
+	return resolved
+}
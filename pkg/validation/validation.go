@@ -0,0 +1,290 @@
+package validation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+// Policy decides what happens to an update with conflicting front proxy paths or cluster settings
+type Policy string
+
+const (
+	// PolicyReject keeps the current config until the conflicts are gone
+	PolicyReject Policy = "reject"
+	// PolicyOldest keeps the path or cluster of the oldest container
+	PolicyOldest Policy = "oldest"
+	// PolicyNewest keeps the path or cluster of the newest container
+	PolicyNewest Policy = "newest"
+)
+
+// ConflictKind tells what is conflicting
+type ConflictKind string
+
+const (
+	// ConflictClusterPaths is a cluster whose endpoints declare different front proxy paths
+	ConflictClusterPaths ConflictKind = "ClusterPaths"
+	// ConflictSharedPath is a front proxy path claimed by more than one cluster on the same domain
+	ConflictSharedPath ConflictKind = "SharedPath"
+	// ConflictClusterSettings is a cluster whose endpoints disagree on settings of the cluster or its routes, e.g. its health check
+	ConflictClusterSettings ConflictKind = "ClusterSettings"
+)
+
+// Conflict describes a conflict and how it was resolved, Kept is empty when the update is rejected,
+// it is the ID of the endpoint whose settings are kept for settings conflicts
+type Conflict struct {
+	Kind     ConflictKind `json:"kind"`
+	Domain   string       `json:"domain,omitempty"`
+	Clusters []string     `json:"clusters"`
+	Paths    []string     `json:"paths,omitempty"`
+	Settings []string     `json:"settings,omitempty"`
+	Kept     string       `json:"kept,omitempty"`
+}
+
+func (conflict Conflict) String() string {
+	switch conflict.Kind {
+	case ConflictClusterPaths:
+		return fmt.Sprintf("cluster %q declares paths %q", conflict.Clusters[0], conflict.Paths)
+	case ConflictClusterSettings:
+		return fmt.Sprintf("endpoints of cluster %q disagree on %s", conflict.Clusters[0], strings.Join(conflict.Settings, ", "))
+	}
+	return fmt.Sprintf("clusters %q claim path %q on domain %q", conflict.Clusters, conflict.Paths[0], conflict.Domain)
+}
+
+// Result is the outcome of a validation
+type Result struct {
+	Policy    Policy     `json:"policy"`
+	Conflicts []Conflict `json:"conflicts"`
+	Rejected  bool       `json:"rejected"`
+}
+
+// Err describes the conflicts of a rejected update, it is nil when the update can be applied
+func (result Result) Err() error {
+	if !result.Rejected {
+		return nil
+	}
+	var descriptions []string
+	for _, conflict := range result.Conflicts {
+		descriptions = append(descriptions, conflict.String())
+	}
+	return fmt.Errorf("conflicting clusters, %s", strings.Join(descriptions, "; "))
+}
+
+func ParsePolicy(value string) (Policy, error) {
+	switch policy := Policy(value); policy {
+	case PolicyReject, PolicyOldest, PolicyNewest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, expecting %q, %q or %q", value, PolicyReject, PolicyOldest, PolicyNewest)
+}
+
+// preferred picks the creation time that wins under the policy
+func (policy Policy) preferred(candidate time.Time, current time.Time) bool {
+	if policy == PolicyNewest {
+		return candidate.After(current)
+	}
+	return candidate.Before(current)
+}
+
+// representative is the creation time of the endpoint that decides for a group of endpoints,
+// it is zero when none of the endpoints has a creation time
+func (policy Policy) representative(endpoints []types.Endpoint) time.Time {
+	var created time.Time
+	for _, endpoint := range endpoints {
+		if endpoint.Created.IsZero() {
+			continue
+		}
+		if created.IsZero() || policy.preferred(endpoint.Created, created) {
+			created = endpoint.Created
+		}
+	}
+	return created
+}
+
+// pick chooses among sorted candidates, ties go to the first candidate, and so does everything
+// when a candidate has no creation time, e.g. endpoints from the File source
+func (policy Policy) pick(candidates []string, groups map[string][]types.Endpoint) string {
+	kept := candidates[0]
+	keptCreated := policy.representative(groups[kept])
+	if keptCreated.IsZero() {
+		return kept
+	}
+	for _, candidate := range candidates[1:] {
+		created := policy.representative(groups[candidate])
+		if created.IsZero() {
+			return candidates[0]
+		}
+		if policy.preferred(created, keptCreated) {
+			kept, keptCreated = candidate, created
+		}
+	}
+	return kept
+}
+
+func sortedKeys(groups map[string][]types.Endpoint) []string {
+	var keys []string
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func groupByPath(endpoints []types.Endpoint) map[string][]types.Endpoint {
+	paths := make(map[string][]types.Endpoint)
+	for _, endpoint := range endpoints {
+		paths[endpoint.FrontProxyPath] = append(paths[endpoint.FrontProxyPath], endpoint)
+	}
+	return paths
+}
+
+// resolveClusterPaths keeps a single front proxy path for every cluster
+func resolveClusterPaths(clusterEndpoints map[string][]types.Endpoint, result *Result) map[string][]types.Endpoint {
+	resolved := make(map[string][]types.Endpoint)
+	for _, clusterName := range sortedKeys(clusterEndpoints) {
+		endpoints := clusterEndpoints[clusterName]
+		resolved[clusterName] = endpoints
+		paths := groupByPath(endpoints)
+		if len(paths) < 2 {
+			continue
+		}
+		conflict := Conflict{
+			Kind:     ConflictClusterPaths,
+			Clusters: []string{clusterName},
+			Paths:    sortedKeys(paths),
+		}
+		if result.Policy != PolicyReject {
+			conflict.Kept = result.Policy.pick(conflict.Paths, paths)
+			resolved[clusterName] = paths[conflict.Kept]
+		}
+		result.Conflicts = append(result.Conflicts, conflict)
+	}
+	return resolved
+}
+
+// getClusterDomains are the domains a cluster is served on, clusters without domains are served on the default domain
+func getClusterDomains(endpoints []types.Endpoint, domainName string) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, domain := range endpoints[0].Domains {
+		if len(domain) < 1 {
+			domain = domainName
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) < 1 {
+		return []string{domainName}
+	}
+	return domains
+}
+
+// withoutDomains takes the lost domains away from a cluster's endpoints, nothing is left when the cluster lost every domain
+func withoutDomains(endpoints []types.Endpoint, lost map[string]bool, domainName string) []types.Endpoint {
+	var domains []string
+	for _, domain := range getClusterDomains(endpoints, domainName) {
+		if !lost[domain] {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) < 1 {
+		return nil
+	}
+	var kept []types.Endpoint
+	for _, endpoint := range endpoints {
+		endpoint.Domains = domains
+		kept = append(kept, endpoint)
+	}
+	return kept
+}
+
+// resolveSharedPaths keeps a single cluster for every front proxy path of a domain.
+// Every claim is settled on its own, a cluster that loses a claim is no longer served on that domain
+// and is dropped once it has lost all of them, so a cluster losing on one domain keeps the others it won
+func resolveSharedPaths(clusterEndpoints map[string][]types.Endpoint, domainName string, result *Result) map[string][]types.Endpoint {
+	claims := make(map[string]map[string][]types.Endpoint)
+	for clusterName, endpoints := range clusterEndpoints {
+		for _, domain := range getClusterDomains(endpoints, domainName) {
+			claim := fmt.Sprintf("%s|%s", domain, endpoints[0].FrontProxyPath)
+			if _, exists := claims[claim]; !exists {
+				claims[claim] = make(map[string][]types.Endpoint)
+			}
+			claims[claim][clusterName] = endpoints
+		}
+	}
+	var claimKeys []string
+	for claim := range claims {
+		claimKeys = append(claimKeys, claim)
+	}
+	sort.Strings(claimKeys)
+
+	lostDomains := make(map[string]map[string]bool)
+	for _, claim := range claimKeys {
+		claimants := claims[claim]
+		if len(claimants) < 2 {
+			continue
+		}
+		parts := strings.SplitN(claim, "|", 2)
+		conflict := Conflict{
+			Kind:     ConflictSharedPath,
+			Domain:   parts[0],
+			Clusters: sortedKeys(claimants),
+			Paths:    []string{parts[1]},
+		}
+		if result.Policy != PolicyReject {
+			conflict.Kept = result.Policy.pick(conflict.Clusters, claimants)
+			for _, clusterName := range conflict.Clusters {
+				if clusterName == conflict.Kept {
+					continue
+				}
+				if _, exists := lostDomains[clusterName]; !exists {
+					lostDomains[clusterName] = make(map[string]bool)
+				}
+				lostDomains[clusterName][conflict.Domain] = true
+			}
+		}
+		result.Conflicts = append(result.Conflicts, conflict)
+	}
+
+	resolved := make(map[string][]types.Endpoint)
+	for clusterName, endpoints := range clusterEndpoints {
+		lost, lostAny := lostDomains[clusterName]
+		if !lostAny {
+			resolved[clusterName] = endpoints
+			continue
+		}
+		if kept := withoutDomains(endpoints, lost, domainName); len(kept) > 0 {
+			resolved[clusterName] = kept
+		}
+	}
+	return resolved
+}
+
+// Validate looks for clusters with more than one front proxy path or with endpoints disagreeing on the cluster's settings,
+// and for paths claimed by more than one cluster,
+// conflicts are resolved according to the policy and the endpoints left are returned, nothing is returned when the update is rejected.
+// Clusters without domains are served on the default domain, domainName
+func Validate(clusterEndpoints map[string][]types.Endpoint, policy Policy, domainName string) (map[string][]types.Endpoint, Result) {
+	log := logger.New("validate")
+	defer log.LogDone()
+	result := Result{Policy: policy, Conflicts: []Conflict{}}
+	resolved := resolveSharedPaths(resolveClusterSettings(resolveClusterPaths(clusterEndpoints, &result), &result), domainName, &result)
+	for _, conflict := range result.Conflicts {
+		if len(conflict.Kept) > 0 {
+			log.Warnf("%s, keeping %q of the %s container", conflict, conflict.Kept, policy)
+			continue
+		}
+		log.Warnf("%s", conflict)
+	}
+	if policy == PolicyReject && len(result.Conflicts) > 0 {
+		result.Rejected = true
+		return nil, result
+	}
+	return resolved, result
+}
@@ -0,0 +1,267 @@
+package validation
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+	"github.com/kahgeh/whale-disco/pkg/registry/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.Initialise(logger.NormalLogLevel)
+	os.Exit(m.Run())
+}
+
+var baseTime = time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+
+// createdAt is the creation time of a container started the given number of minutes after the base time, -1 is unknown
+func createdAt(minutes int) time.Time {
+	if minutes < 0 {
+		return time.Time{}
+	}
+	return baseTime.Add(time.Duration(minutes) * time.Minute)
+}
+
+func newEndpoint(clusterName string, path string, minutes int, domains ...string) types.Endpoint {
+	return types.Endpoint{
+		UniqueID:       clusterName + path,
+		ClusterName:    clusterName,
+		FrontProxyPath: path,
+		Created:        createdAt(minutes),
+		Domains:        domains,
+	}
+}
+
+func group(endpoints ...types.Endpoint) map[string][]types.Endpoint {
+	clusterEndpoints := make(map[string][]types.Endpoint)
+	for _, endpoint := range endpoints {
+		clusterEndpoints[endpoint.ClusterName] = append(clusterEndpoints[endpoint.ClusterName], endpoint)
+	}
+	return clusterEndpoints
+}
+
+// served gives the path and domains every cluster left is served on
+func served(clusterEndpoints map[string][]types.Endpoint) map[string][]string {
+	routes := make(map[string][]string)
+	for clusterName, endpoints := range clusterEndpoints {
+		routes[clusterName] = append([]string{endpoints[0].FrontProxyPath}, endpoints[0].Domains...)
+	}
+	return routes
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    Policy
+		endpoints []types.Endpoint
+		served    map[string][]string
+		kept      []string
+		rejected  bool
+	}{
+		{
+			name:      "no conflicts",
+			policy:    PolicyOldest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/a", 1), newEndpoint("b", "/b", 2)},
+			served:    map[string][]string{"a": {"/a"}, "b": {"/b"}},
+			kept:      []string{},
+		},
+		{
+			name:   "cluster paths, oldest",
+			policy: PolicyOldest,
+			endpoints: []types.Endpoint{
+				newEndpoint("a", "/new", 5),
+				newEndpoint("a", "/old", 1),
+			},
+			served: map[string][]string{"a": {"/old"}},
+			kept:   []string{"/old"},
+		},
+		{
+			name:   "cluster paths, newest",
+			policy: PolicyNewest,
+			endpoints: []types.Endpoint{
+				newEndpoint("a", "/new", 5),
+				newEndpoint("a", "/old", 1),
+			},
+			served: map[string][]string{"a": {"/new"}},
+			kept:   []string{"/new"},
+		},
+		{
+			name:      "shared path, oldest",
+			policy:    PolicyOldest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/p", 5), newEndpoint("b", "/p", 1)},
+			served:    map[string][]string{"b": {"/p"}},
+			kept:      []string{"b"},
+		},
+		{
+			name:      "shared path, newest",
+			policy:    PolicyNewest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/p", 5), newEndpoint("b", "/p", 1)},
+			served:    map[string][]string{"a": {"/p"}},
+			kept:      []string{"a"},
+		},
+		{
+			name:   "cluster losing one domain keeps the domain it won",
+			policy: PolicyOldest,
+			endpoints: []types.Endpoint{
+				newEndpoint("a", "/p", 2, "x", "y"),
+				newEndpoint("b", "/p", 3, "x"),
+				newEndpoint("c", "/p", 1, "y"),
+			},
+			served: map[string][]string{"a": {"/p", "x"}, "c": {"/p", "y"}},
+			kept:   []string{"a", "c"},
+		},
+		{
+			name:   "cluster losing every domain is dropped",
+			policy: PolicyOldest,
+			endpoints: []types.Endpoint{
+				newEndpoint("a", "/p", 3, "x", "y"),
+				newEndpoint("b", "/p", 2, "x"),
+				newEndpoint("c", "/p", 1, "y"),
+			},
+			served: map[string][]string{"b": {"/p", "x"}, "c": {"/p", "y"}},
+			kept:   []string{"b", "c"},
+		},
+		{
+			name:      "different domains do not conflict",
+			policy:    PolicyOldest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/p", 1, "x"), newEndpoint("b", "/p", 2, "y")},
+			served:    map[string][]string{"a": {"/p", "x"}, "b": {"/p", "y"}},
+			kept:      []string{},
+		},
+		{
+			name:      "clusters without domains share the default domain, reject",
+			policy:    PolicyReject,
+			endpoints: []types.Endpoint{newEndpoint("a", "/api", 1), newEndpoint("b", "/api", 2, "*")},
+			kept:      []string{""},
+			rejected:  true,
+		},
+		{
+			name:      "clusters without domains share the default domain, newest",
+			policy:    PolicyNewest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/api", 2), newEndpoint("b", "/api", 1, "*", "x")},
+			served:    map[string][]string{"a": {"/api"}, "b": {"/api", "x"}},
+			kept:      []string{"a"},
+		},
+		{
+			name:      "unknown creation time, oldest goes by name",
+			policy:    PolicyOldest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/p", 5), newEndpoint("b", "/p", -1)},
+			served:    map[string][]string{"a": {"/p"}},
+			kept:      []string{"a"},
+		},
+		{
+			name:      "unknown creation time, newest goes by name",
+			policy:    PolicyNewest,
+			endpoints: []types.Endpoint{newEndpoint("a", "/p", -1), newEndpoint("b", "/p", 5)},
+			served:    map[string][]string{"a": {"/p"}},
+			kept:      []string{"a"},
+		},
+		{
+			name:   "unknown creation time of one endpoint, the others decide",
+			policy: PolicyOldest,
+			endpoints: []types.Endpoint{
+				newEndpoint("a", "/p", 5),
+				newEndpoint("b", "/p", -1),
+				newEndpoint("b", "/p", 1),
+			},
+			served: map[string][]string{"b": {"/p"}},
+			kept:   []string{"b"},
+		},
+		{
+			name:      "reject",
+			policy:    PolicyReject,
+			endpoints: []types.Endpoint{newEndpoint("a", "/p", 5), newEndpoint("b", "/p", 1)},
+			kept:      []string{""},
+			rejected:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, result := Validate(group(tc.endpoints...), tc.policy, "*")
+			if result.Rejected != tc.rejected {
+				t.Fatalf("rejected is %v", result.Rejected)
+			}
+			if (result.Err() != nil) != tc.rejected {
+				t.Errorf("error is %v", result.Err())
+			}
+			kept := []string{}
+			for _, conflict := range result.Conflicts {
+				kept = append(kept, conflict.Kept)
+			}
+			sort.Strings(kept)
+			if !reflect.DeepEqual(kept, tc.kept) {
+				t.Errorf("kept %q, expecting %q", kept, tc.kept)
+			}
+			if tc.rejected {
+				if resolved != nil {
+					t.Errorf("rejected update resolved to %v", served(resolved))
+				}
+				return
+			}
+			if routes := served(resolved); !reflect.DeepEqual(routes, tc.served) {
+				t.Errorf("served %v, expecting %v", routes, tc.served)
+			}
+		})
+	}
+}
+
+func TestValidateClusterSettings(t *testing.T) {
+	older := newEndpoint("a", "/a", 1, "x")
+	older.UniqueID, older.LbPolicy = "older", types.LbRoundRobin
+	newer := newEndpoint("a", "/a", 5, "y")
+	newer.UniqueID, newer.LbPolicy = "newer", types.LbRingHash
+	newer.HashPolicies = []types.HashPolicy{{Kind: types.HashCookie, Name: "session"}}
+	for _, tc := range []struct {
+		policy   Policy
+		kept     string
+		domains  []string
+		lbPolicy types.LbPolicy
+	}{
+		{PolicyOldest, "older", []string{"x"}, types.LbRoundRobin},
+		{PolicyNewest, "newer", []string{"y"}, types.LbRingHash},
+		{PolicyReject, "", nil, ""},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			resolved, result := Validate(group(older, newer), tc.policy, "*")
+			if len(result.Conflicts) != 1 {
+				t.Fatalf("conflicts are %+v", result.Conflicts)
+			}
+			conflict := result.Conflicts[0]
+			if conflict.Kind != ConflictClusterSettings || conflict.Kept != tc.kept {
+				t.Errorf("conflict is %+v", conflict)
+			}
+			if settings := []string{"Domains", "LbPolicy", "HashPolicies"}; !reflect.DeepEqual(conflict.Settings, settings) {
+				t.Errorf("settings are %q, expecting %q", conflict.Settings, settings)
+			}
+			if tc.policy == PolicyReject {
+				if !result.Rejected {
+					t.Error("update is not rejected")
+				}
+				return
+			}
+			endpoints := resolved["a"]
+			if len(endpoints) != 2 {
+				t.Fatalf("endpoints are %+v", endpoints)
+			}
+			for _, endpoint := range endpoints {
+				if !reflect.DeepEqual(endpoint.Domains, tc.domains) || endpoint.LbPolicy != tc.lbPolicy {
+					t.Errorf("endpoint %s has domains %q and lb policy %q", endpoint.UniqueID, endpoint.Domains, endpoint.LbPolicy)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, value := range []string{"reject", "oldest", "newest"} {
+		if policy, err := ParsePolicy(value); err != nil || string(policy) != value {
+			t.Errorf("%q parsed as %q, %v", value, policy, err)
+		}
+	}
+	if _, err := ParsePolicy("random"); err == nil {
+		t.Error("expected an error")
+	}
+}
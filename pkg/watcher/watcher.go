@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/kahgeh/whale-disco/pkg/logger"
+)
+
+func fingerprint(path string) (uint64, error) {
+	h := fnv.New64a()
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(h, "%s|%d|%d|", info.Name(), info.Size(), info.ModTime().UnixNano())
+	if !info.IsDir() {
+		return h.Sum64(), nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%s|%d|%d|", entry.Name(), entry.Size(), entry.ModTime().UnixNano())
+	}
+	return h.Sum64(), nil
+}
+
+// Watch polls a file or directory and signals whenever its content changes, the first signal is sent straight away
+func Watch(appContext context.Context, path string, interval time.Duration) <-chan struct{} {
+	log := logger.New("watchPath")
+	defer log.LogDone()
+	changes := make(chan struct{})
+	go func() {
+		defer close(changes)
+		var previous uint64
+		first := true
+		for {
+			current, err := fingerprint(path)
+			if err != nil {
+				log.Warnf("unable to read %q, %s", path, err.Error())
+			} else if first || current != previous {
+				log.Debugf("change detected in %q", path)
+				select {
+				case changes <- struct{}{}:
+				case <-appContext.Done():
+					return
+				}
+				previous = current
+				first = false
+			}
+			select {
+			case <-time.After(interval):
+			case <-appContext.Done():
+				return
+			}
+		}
+	}()
+	return changes
+}